@@ -4,13 +4,19 @@ go 1.12
 
 require (
 	github.com/auth0/go-jwt-middleware v1.0.1
-	github.com/form3tech-oss/jwt-go v3.2.5+incompatible
-	github.com/go-chi/chi v4.1.2+incompatible
+	github.com/form3tech-oss/jwt-go v3.2.5+incompatible // indirect
 	github.com/go-chi/chi/v5 v5.0.5
+	github.com/go-chi/cors v1.2.1
 	github.com/go-chi/docgen v1.2.0
 	github.com/go-chi/render v1.0.1
+	github.com/golang-jwt/jwt v3.2.2+incompatible
+	github.com/prometheus/client_golang v1.11.1
 	github.com/sirupsen/logrus v1.8.1
-	github.com/stretchr/testify v1.3.0
-	golang.org/x/net v0.0.0-20190613194153-d28f0bde5980 // indirect
+	github.com/stretchr/testify v1.7.0
+	go.opentelemetry.io/otel v1.3.0
+	go.opentelemetry.io/otel/sdk v1.3.0
+	go.opentelemetry.io/otel/trace v1.3.0
+	golang.org/x/net v0.0.0-20200625001655-4c5254603344
 	golang.org/x/sys v0.0.0-20211025201205-69cdffdb9359 // indirect
+	golang.org/x/time v0.0.0-20210723032227-1f47c861a9ac
 )
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/render"
+)
+
+const (
+	// AuthSchemeAPIKey is the CtxAuthSchemeKey value of requests authenticated with an API key
+	AuthSchemeAPIKey = "api_key"
+	// DefaultAPIKeyHeader is the header with the API key
+	DefaultAPIKeyHeader = "X-Api-Key"
+)
+
+// APIKeyAuthOptions configures the APIKeyAuth middleware
+type APIKeyAuthOptions struct {
+	// Header with the API key; defaults to DefaultAPIKeyHeader
+	Header string
+	// Keys maps valid API keys to the identities of their owners, like service names
+	Keys map[string]string
+	// URLPrefixes limits API key authentication to paths with these prefixes, matched like
+	// JWTAuthenticatorOptions.PublicURLPrefixes; requests to other paths are passed through.
+	// Empty list applies it to all the requests.
+	URLPrefixes []string
+	// AllowBearer passes requests without the API key header to the next middleware instead
+	// of rejecting them, so the JwtAuthenticator can authenticate them with a bearer token.
+	// It's only safe when the JwtAuthenticator runs after this middleware and doesn't treat
+	// the paths as public.
+	AllowBearer bool
+}
+
+// NewAPIKeyAuth returns a middleware, which accepts only requests with one of the valid
+// API keys in the header; the others are rejected with 401. validKeys maps keys to the
+// identities of their owners, which are set to CtxUserKey unless they're empty. It's meant
+// to be mounted per route, like r.With(NewAPIKeyAuth("X-Api-Key", keys)).Post(...), on
+// paths the JwtAuthenticator treats as public, as it runs after the server-wide authentication.
+func NewAPIKeyAuth(headerName string, validKeys map[string]string) func(next http.Handler) http.Handler {
+	return NewAPIKeyAuthWithOptions(APIKeyAuthOptions{Header: headerName, Keys: validKeys})
+}
+
+// NewAPIKeyAuthWithOptions returns the APIKeyAuth middleware configured with APIKeyAuthOptions.
+// Keys are compared in constant time. AuthSchemeAPIKey is set to CtxAuthSchemeKey of
+// authenticated requests, so the JwtAuthenticator skips them.
+func NewAPIKeyAuthWithOptions(options APIKeyAuthOptions) func(next http.Handler) http.Handler {
+	type apiKey struct {
+		hash     [sha256.Size]byte
+		identity string
+	}
+	keys := make([]apiKey, 0, len(options.Keys))
+	for key, identity := range options.Keys {
+		keys = append(keys, apiKey{hash: sha256.Sum256([]byte(key)), identity: identity})
+	}
+	header := options.Header
+	if header == "" {
+		header = DefaultAPIKeyHeader
+	}
+	// authenticate compares the hash of the key with all the keys, so the time it takes
+	// doesn't depend on which key matched
+	authenticate := func(key string) (string, bool) {
+		hash := sha256.Sum256([]byte(key))
+		identity, found := "", 0
+		for _, k := range keys {
+			if subtle.ConstantTimeCompare(hash[:], k.hash[:]) == 1 {
+				identity, found = k.identity, 1
+			}
+		}
+		return identity, found == 1
+	}
+
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if len(options.URLPrefixes) > 0 && !matchesAnyPrefix(r.URL.EscapedPath(), options.URLPrefixes) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			key := r.Header.Get(header)
+			if key == "" {
+				if options.AllowBearer {
+					next.ServeHTTP(w, r)
+					return
+				}
+				render.Render(w, r, ErrAuth(errors.New("API key is required")))
+				return
+			}
+			identity, ok := authenticate(key)
+			if !ok {
+				render.Render(w, r, ErrAuth(errors.New("invalid API key")))
+				return
+			}
+			next.ServeHTTP(w, withAuthenticatedUser(r, AuthSchemeAPIKey, identity))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
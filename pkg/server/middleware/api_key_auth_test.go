@@ -0,0 +1,44 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/piontec/go-chi-middleware-server/pkg/server/middleware"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeyAuth(t *testing.T) {
+	var user, scheme string
+	var hasUser bool
+	handler := middleware.NewAPIKeyAuth("X-Service-Key", map[string]string{"key-1": "reports", "key-2": ""})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, hasUser = middleware.GetUser(r)
+			scheme, _ = middleware.GetAuthScheme(r)
+		}))
+	serve := func(key string) int {
+		user, hasUser, scheme = "", false, ""
+		req := httptest.NewRequest("GET", "/", nil)
+		if key != "" {
+			req.Header.Set("X-Service-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve("key-1"))
+	assert.Equal(t, "reports", user)
+	assert.Equal(t, middleware.AuthSchemeAPIKey, scheme)
+	// keys without identity authenticate without setting the user
+	assert.Equal(t, http.StatusOK, serve("key-2"))
+	assert.False(t, hasUser)
+	assert.Equal(t, middleware.AuthSchemeAPIKey, scheme)
+
+	assert.Equal(t, http.StatusUnauthorized, serve(""), "missing key")
+	assert.Equal(t, http.StatusUnauthorized, serve("key-3"), "invalid key")
+	assert.Equal(t, http.StatusUnauthorized, serve("key-"), "invalid key")
+	assert.Equal(t, "", scheme)
+}
@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AuthErrorReason tells why a request failed authentication
+type AuthErrorReason int
+
+const (
+	// AuthReasonMissingToken means the request has no bearer token
+	AuthReasonMissingToken AuthErrorReason = iota
+	// AuthReasonMalformed means the Authorization header or the token can't be parsed
+	AuthReasonMalformed
+	// AuthReasonInvalidType means the token's 'typ' header isn't allowed
+	AuthReasonInvalidType
+	// AuthReasonInvalidAudience means the token's 'aud' claim isn't accepted
+	AuthReasonInvalidAudience
+	// AuthReasonInvalidIssuer means the token's 'iss' claim isn't accepted
+	AuthReasonInvalidIssuer
+	// AuthReasonKeyNotFound means the JWKS has no key with the token's key ID
+	AuthReasonKeyNotFound
+	// AuthReasonKeyUnavailable means the keys couldn't be loaded from the JWKS source
+	AuthReasonKeyUnavailable
+	// AuthReasonInvalidSignature means the token's signature or signing method is invalid
+	AuthReasonInvalidSignature
+	// AuthReasonExpired means the token's 'exp' claim is in the past
+	AuthReasonExpired
+	// AuthReasonNotValidYet means the token's 'nbf' or 'iat' claim is in the future
+	AuthReasonNotValidYet
+	// AuthReasonInvalidClaim means one of the custom claim validators rejected the token
+	AuthReasonInvalidClaim
+	// AuthReasonInactive means the introspection endpoint reported the token as not active
+	AuthReasonInactive
+	// AuthReasonIntrospectionFailed means the token couldn't be introspected, e.g. because
+	// of a network failure
+	AuthReasonIntrospectionFailed
+)
+
+var authErrorReasonNames = map[AuthErrorReason]string{
+	AuthReasonMissingToken:        "missing_token",
+	AuthReasonMalformed:           "malformed",
+	AuthReasonInvalidType:         "invalid_type",
+	AuthReasonInvalidAudience:     "invalid_audience",
+	AuthReasonInvalidIssuer:       "invalid_issuer",
+	AuthReasonKeyNotFound:         "key_not_found",
+	AuthReasonKeyUnavailable:      "key_unavailable",
+	AuthReasonInvalidSignature:    "invalid_signature",
+	AuthReasonExpired:             "expired",
+	AuthReasonNotValidYet:         "not_valid_yet",
+	AuthReasonInvalidClaim:        "invalid_claim",
+	AuthReasonInactive:            "inactive",
+	AuthReasonIntrospectionFailed: "introspection_failed",
+}
+
+func (r AuthErrorReason) String() string {
+	if name, found := authErrorReasonNames[r]; found {
+		return name
+	}
+	return fmt.Sprintf("AuthErrorReason(%d)", int(r))
+}
+
+// AuthError is returned when a request fails authentication
+type AuthError struct {
+	Reason AuthErrorReason
+	Err    error
+}
+
+func newAuthError(reason AuthErrorReason, message string) *AuthError {
+	return &AuthError{Reason: reason, Err: errors.New(message)}
+}
+
+func (e *AuthError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// bearerErrorCode returns the RFC 6750 error code of the failure; requests without a token
+// get no error code
+func (e *AuthError) bearerErrorCode() string {
+	switch e.Reason {
+	case AuthReasonMissingToken:
+		return ""
+	case AuthReasonMalformed:
+		return "invalid_request"
+	default:
+		return "invalid_token"
+	}
+}
+
+// clientMessage returns the failure description safe to send to clients, with internal
+// details, like key loading errors, hidden
+func (e *AuthError) clientMessage() string {
+	if e.Reason == AuthReasonKeyUnavailable {
+		return "can't verify token signature"
+	}
+	if e.Reason == AuthReasonIntrospectionFailed {
+		return "can't verify token"
+	}
+	return e.Err.Error()
+}
+
+// setWWWAuthenticate sets the WWW-Authenticate header for a failed authentication as
+// described in RFC 6750, section 3
+func (e *AuthError) setWWWAuthenticate(w http.ResponseWriter) {
+	code := e.bearerErrorCode()
+	if code == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		return
+	}
+	// quotes and backslashes aren't allowed in error_description
+	description := strings.NewReplacer(`"`, "'", `\`, "/").Replace(e.clientMessage())
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="%s", error_description="%s"`, code, description))
+}
@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/render"
+)
+
+const (
+	// AuthSchemeBasic is the CtxAuthSchemeKey value of requests authenticated with Basic auth
+	AuthSchemeBasic = "basic"
+	// DefaultBasicAuthRealm is the realm sent in the WWW-Authenticate header
+	DefaultBasicAuthRealm = "restricted"
+)
+
+// BasicAuthOptions configures the BasicAuth middleware
+type BasicAuthOptions struct {
+	// Users maps user names to their passwords
+	Users map[string]string
+	// URLPrefixes limits Basic auth to paths with these prefixes, matched like
+	// JWTAuthenticatorOptions.PublicURLPrefixes; requests to other paths are passed through.
+	// Empty list applies Basic auth to all the requests.
+	URLPrefixes []string
+	// AllowBearer passes requests without Basic credentials to the next middleware instead
+	// of rejecting them, so the JwtAuthenticator can authenticate them with a bearer token.
+	// It's only safe when the JwtAuthenticator runs after this middleware and doesn't treat
+	// the paths as public.
+	AllowBearer bool
+	// Realm sent in the WWW-Authenticate header; defaults to DefaultBasicAuthRealm
+	Realm string
+}
+
+// NewBasicAuth returns a middleware, which accepts only requests with HTTP Basic credentials
+// of one of the users, mapped to their passwords; the others are rejected with 401. It's
+// meant to be mounted per route, like r.With(NewBasicAuth(users)).Post(...), on paths the
+// JwtAuthenticator treats as public, as it runs after the server-wide authentication.
+func NewBasicAuth(users map[string]string) func(next http.Handler) http.Handler {
+	return NewBasicAuthWithOptions(BasicAuthOptions{Users: users})
+}
+
+// CheckBasicAuthUsers returns an error if any user has an empty name or password, e.g.
+// because the environment variable with the password isn't set, as such users would let
+// anyone in with empty credentials
+func CheckBasicAuthUsers(users map[string]string) error {
+	for user, password := range users {
+		if user == "" {
+			return errors.New("basic auth user with an empty name is configured")
+		}
+		if password == "" {
+			return fmt.Errorf("basic auth user %s has an empty password", user)
+		}
+	}
+	return nil
+}
+
+// NewBasicAuthWithOptions returns the BasicAuth middleware configured with BasicAuthOptions.
+// Credentials are compared in constant time. The user name of authenticated requests is
+// set to CtxUserKey and AuthSchemeBasic to CtxAuthSchemeKey, so the JwtAuthenticator skips
+// them. Basic auth sends the password with every request, so it must be used only over TLS.
+// It panics if any user has an empty name or password, see CheckBasicAuthUsers.
+func NewBasicAuthWithOptions(options BasicAuthOptions) func(next http.Handler) http.Handler {
+	if err := CheckBasicAuthUsers(options.Users); err != nil {
+		panic(err)
+	}
+	type credentials struct {
+		user, password [sha256.Size]byte
+		name           string
+	}
+	users := make([]credentials, 0, len(options.Users))
+	for user, password := range options.Users {
+		users = append(users, credentials{
+			user:     sha256.Sum256([]byte(user)),
+			password: sha256.Sum256([]byte(password)),
+			name:     user,
+		})
+	}
+	realm := options.Realm
+	if realm == "" {
+		realm = DefaultBasicAuthRealm
+	}
+	challenge := fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, realm)
+	// authenticate compares hashes of the credentials with all the users, so the time it
+	// takes doesn't depend on which part of the credentials matched
+	authenticate := func(user, password string) (string, bool) {
+		userHash, passwordHash := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(password))
+		found := ""
+		for _, c := range users {
+			match := subtle.ConstantTimeCompare(userHash[:], c.user[:]) &
+				subtle.ConstantTimeCompare(passwordHash[:], c.password[:])
+			if match == 1 {
+				found = c.name
+			}
+		}
+		return found, found != ""
+	}
+
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if len(options.URLPrefixes) > 0 && !matchesAnyPrefix(r.URL.EscapedPath(), options.URLPrefixes) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			user, password, hasCredentials := r.BasicAuth()
+			if !hasCredentials && options.AllowBearer {
+				next.ServeHTTP(w, r)
+				return
+			}
+			name, ok := authenticate(user, password)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", challenge)
+				if hasCredentials {
+					render.Render(w, r, ErrAuth(errors.New("invalid credentials")))
+				} else {
+					render.Render(w, r, ErrAuth(errors.New("basic authentication is required")))
+				}
+				return
+			}
+			next.ServeHTTP(w, withAuthenticatedUser(r, AuthSchemeBasic, name))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// matchesAnyPrefix checks if the path has any of the prefixes, see hasPathPrefix
+func matchesAnyPrefix(urlPath string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if hasPathPrefix(urlPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
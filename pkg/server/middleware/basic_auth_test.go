@@ -0,0 +1,55 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/piontec/go-chi-middleware-server/pkg/server/middleware"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBasicAuth(t *testing.T) {
+	var user, scheme string
+	handler := middleware.NewBasicAuth(map[string]string{"svc": "s3cret", "other": "pass"})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, _ = middleware.GetUser(r)
+			scheme, _ = middleware.GetAuthScheme(r)
+		}))
+	serve := func(setAuth func(r *http.Request)) *httptest.ResponseRecorder {
+		user, scheme = "", ""
+		req := httptest.NewRequest("GET", "/", nil)
+		setAuth(req)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(func(r *http.Request) { r.SetBasicAuth("svc", "s3cret") })
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "svc", user)
+	assert.Equal(t, middleware.AuthSchemeBasic, scheme)
+
+	for _, setAuth := range []func(r *http.Request){
+		func(r *http.Request) { r.SetBasicAuth("svc", "pass") },
+		func(r *http.Request) { r.SetBasicAuth("unknown", "s3cret") },
+		func(r *http.Request) { r.Header.Set("Authorization", "Bearer token") },
+		func(r *http.Request) {},
+	} {
+		rec = serve(setAuth)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.Equal(t, `Basic realm="restricted", charset="UTF-8"`, rec.Header().Get("WWW-Authenticate"))
+		assert.Equal(t, "", user)
+	}
+}
+
+func TestBasicAuthRejectsEmptyCredentials(t *testing.T) {
+	assert.Nil(t, middleware.CheckBasicAuthUsers(map[string]string{"svc": "s3cret"}))
+	for _, users := range []map[string]string{{"svc": ""}, {"": "s3cret"}} {
+		assert.NotNil(t, middleware.CheckBasicAuthUsers(users))
+		assert.Panics(t, func() {
+			middleware.NewBasicAuth(users)
+		})
+	}
+}
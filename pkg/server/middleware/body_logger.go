@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// DefaultLogBodyMaxBytes is the default limit of bytes of request and response bodies added to logs
+const DefaultLogBodyMaxBytes = 4096
+
+// NewBodyLogger returns a middleware, which adds up to maxBytes of the request and response
+// bodies to the request log entry as 'req_body' and 'resp_body' fields, together with the
+// number of request body bytes read by the handler as 'req_bytes_length'. The request body
+// is captured while the handler reads it, so only the part it actually read is logged. Truncated bodies
+// are marked with 'req_body_truncated' and 'resp_body_truncated' fields. Only maxBytes of
+// each body are kept in memory. If maxBytes is not positive, DefaultLogBodyMaxBytes is used.
+// It has to be used after the structured logger.
+func NewBodyLogger(maxBytes int) func(next http.Handler) http.Handler {
+	if maxBytes <= 0 {
+		maxBytes = DefaultLogBodyMaxBytes
+	}
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			reqBody := &cappedBuffer{max: maxBytes}
+			counter := &countingReadCloser{ReadCloser: r.Body}
+			if r.Body != nil && r.Body != http.NoBody {
+				// the handler reads through the tee, so the body is never buffered as a whole
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.TeeReader(counter, reqBody), counter}
+			}
+			respBody := &cappedBuffer{max: maxBytes}
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			ww.Tee(respBody)
+
+			next.ServeHTTP(ww, r)
+
+			fields := map[string]interface{}{
+				"req_bytes_length": counter.count,
+				"req_body":         reqBody.String(),
+				"resp_body":        respBody.String(),
+			}
+			if reqBody.truncated {
+				fields["req_body_truncated"] = true
+			}
+			if respBody.truncated {
+				fields["resp_body_truncated"] = true
+			}
+			LogEntrySetFields(r, fields)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// cappedBuffer keeps up to max bytes written to it and silently drops the rest
+type cappedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// countingReadCloser counts bytes read from the wrapped body
+type countingReadCloser struct {
+	io.ReadCloser
+	count int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	if c.ReadCloser == nil {
+		return 0, io.EOF
+	}
+	n, err := c.ReadCloser.Read(p)
+	c.count += int64(n)
+	return n, err
+}
+
+func (c *countingReadCloser) Close() error {
+	if c.ReadCloser == nil {
+		return nil
+	}
+	return c.ReadCloser.Close()
+}
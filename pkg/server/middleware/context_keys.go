@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// ContextKey is the type of Context() keys set by the middleware in this package. Unlike
+// plain strings, typed keys can't collide with keys set by other packages, so they should
+// be used as targets of claim mappings, like msm.ContextKey("email").
+type ContextKey string
+
+// CtxJWTKey is the Context() key under which the JwtAuthenticator stores the validated
+// *jwt.Token; all middleware reading the token use it, see GetToken. It's kept an untyped
+// string for compatibility with code reading r.Context().Value("jwt_token").
+const CtxJWTKey = "jwt_token"
+
+const (
+	// CtxUserKey allows to get the user name (subject) of an authenticated request
+	CtxUserKey ContextKey = "user"
+	// CtxRolesKey allows to get the []string roles of an authenticated request
+	CtxRolesKey ContextKey = "roles"
+	// CtxIsAdminKey allows to get the bool flag telling if the user has the admin role
+	CtxIsAdminKey ContextKey = "is_admin"
+	// CtxAuthSchemeKey allows to get the scheme, like "basic", of a request authenticated
+	// by other middleware than the JwtAuthenticator, which then skips the request
+	CtxAuthSchemeKey ContextKey = "auth_scheme"
+)
+
+const (
+	// AdminUserRole is the default role granting admin rights
+	AdminUserRole = "admin"
+	// DefaultUserClaim is the default JWT claim with the user name
+	DefaultUserClaim = "sub"
+	// DefaultRolesClaim is the default JWT claim with user roles
+	DefaultRolesClaim = "roles"
+)
+
+// GetClaimString returns the string claim stored in the context under key by the ContextSetter
+func GetClaimString(ctx context.Context, key interface{}) (string, bool) {
+	value, ok := ctx.Value(key).(string)
+	return value, ok
+}
+
+// GetClaimStrings returns the claim stored in the context under key by the ContextSetter as
+// a slice; a single string claim is returned as a one element slice
+func GetClaimStrings(ctx context.Context, key interface{}) ([]string, bool) {
+	value := ctx.Value(key)
+	if value == nil {
+		return nil, false
+	}
+	values, err := claimStrings(value)
+	return values, err == nil
+}
+
+// GetClaimBool returns the boolean claim stored in the context under key by the ContextSetter
+func GetClaimBool(ctx context.Context, key interface{}) (bool, bool) {
+	value, ok := ctx.Value(key).(bool)
+	return value, ok
+}
+
+// GetClaimNumber returns the numeric claim stored in the context under key by the
+// ContextSetter; JSON numbers in claims are decoded as float64
+func GetClaimNumber(ctx context.Context, key interface{}) (float64, bool) {
+	value, ok := ctx.Value(key).(float64)
+	return value, ok
+}
+
+// GetToken returns the JWT token validated by the JwtAuthenticator
+func GetToken(r *http.Request) (*jwt.Token, bool) {
+	token, ok := r.Context().Value(CtxJWTKey).(*jwt.Token)
+	return token, ok && token != nil
+}
+
+// GetUser returns the user name set by the UserInfoSetter
+func GetUser(r *http.Request) (string, bool) {
+	user, ok := r.Context().Value(CtxUserKey).(string)
+	return user, ok
+}
+
+// GetRoles returns the roles set by the UserInfoSetter
+func GetRoles(r *http.Request) ([]string, bool) {
+	roles, ok := r.Context().Value(CtxRolesKey).([]string)
+	return roles, ok
+}
+
+// GetAuthScheme returns the scheme of a request authenticated by other middleware than the
+// JwtAuthenticator, like "basic"
+func GetAuthScheme(r *http.Request) (string, bool) {
+	scheme, ok := r.Context().Value(CtxAuthSchemeKey).(string)
+	return scheme, ok && scheme != ""
+}
+
+// withAuthenticatedUser marks the request as authenticated with the scheme as the user;
+// empty user isn't set
+func withAuthenticatedUser(r *http.Request, scheme, user string) *http.Request {
+	ctx := context.WithValue(r.Context(), CtxAuthSchemeKey, scheme)
+	if user != "" {
+		ctx = context.WithValue(ctx, CtxUserKey, user)
+	}
+	return r.WithContext(ctx)
+}
+
+// IsAdmin returns true if the UserInfoSetter found the admin role in the user's roles
+func IsAdmin(r *http.Request) bool {
+	isAdmin, _ := r.Context().Value(CtxIsAdminKey).(bool)
+	return isAdmin
+}
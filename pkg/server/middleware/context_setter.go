@@ -6,24 +6,96 @@ import (
 	"fmt"
 	"net/http"
 
-	"github.com/form3tech-oss/jwt-go"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
+	"github.com/golang-jwt/jwt"
 )
 
-// NewContextSetter returns instance of UserInfoSetter middleware
-// UserInfoSetter is a middleware, which sets user name, roles and admin flags based on
-// JWT claims
+// reservedContextKeys are Context() keys used by the server and its middleware, which
+// can't be used as targets of claim mappings
+var reservedContextKeys = []interface{}{
+	CtxJWTKey,
+	CtxHeaderValuesKey,
+	render.ContentTypeCtxKey,
+	middleware.RequestIDKey,
+	middleware.LogEntryCtxKey,
+	chi.RouteCtxKey,
+	CtxAuthSchemeKey,
+	CtxUserKey,
+	CtxRolesKey,
+	CtxIsAdminKey,
+}
+
+// CheckContextKeys returns an error if any claim is mapped to a Context() key reserved
+// for the server's internal use, as setting it would overwrite server managed state
+func CheckContextKeys(claimToContextKeyMapping map[string]interface{}) error {
+	for claimKey, contextKey := range claimToContextKeyMapping {
+		for _, reserved := range reservedContextKeys {
+			if contextKey == reserved {
+				return fmt.Errorf("claim %s is mapped to the reserved context key %v", claimKey, contextKey)
+			}
+		}
+	}
+	return nil
+}
+
+// ContextSetterOptions configures the ContextSetter middleware
+type ContextSetterOptions struct {
+	// ClaimToContextKeyMapping maps JWT claims to Context() keys
+	ClaimToContextKeyMapping map[string]interface{}
+	// SkipMissingClaims makes all claims optional: when a claim is missing, its Context() key
+	// isn't set and the request continues instead of being rejected with 401
+	SkipMissingClaims bool
+	// OptionalClaims lists claims of the mapping, which are skipped when missing
+	OptionalClaims []string
+	// OmitUserLogField disables adding the token's 'sub' claim as the `user` field to the
+	// request log entry
+	OmitUserLogField bool
+}
+
+// NewContextSetter returns a middleware, which copies JWT claims to Context() keys as
+// configured by the mapping. Claim keys can be dotted paths to nested claims, like
+// "address.country"; a missing path segment is handled like a missing claim. Requests
+// with missing claims are rejected with 401. It panics if any claim is mapped to a
+// reserved key, see CheckContextKeys. For user name, roles and admin flag see NewUserInfoSetter.
+// The 'sub' claim of the token is added as the `user` field to the request log entry, so
+// the log lines of authenticated requests are attributable to users.
 func NewContextSetter(claimToContextKeyMapping map[string]interface{}) func(http.Handler) http.Handler {
+	return NewContextSetterWithOptions(ContextSetterOptions{ClaimToContextKeyMapping: claimToContextKeyMapping})
+}
+
+// NewContextSetterWithOptions returns the ContextSetter middleware configured with
+// ContextSetterOptions
+func NewContextSetterWithOptions(options ContextSetterOptions) func(http.Handler) http.Handler {
+	claimToContextKeyMapping := options.ClaimToContextKeyMapping
+	if err := CheckContextKeys(claimToContextKeyMapping); err != nil {
+		panic(err)
+	}
+	optional := make(map[string]bool, len(options.OptionalClaims))
+	for _, claimKey := range options.OptionalClaims {
+		optional[claimKey] = true
+	}
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
-			token, ok := r.Context().Value(CtxJWTKey).(*jwt.Token)
-			// if there's no JWT token or no mapping configured, move to the next middleware
-			if !ok || token == nil || len(claimToContextKeyMapping) == 0 {
+			token, ok := GetToken(r)
+			// if there's no JWT token, like for public paths, move to the next middleware
+			if !ok {
 				next.ServeHTTP(w, r)
 				return
 			}
 
 			claims, ok := token.Claims.(jwt.MapClaims)
+			if !options.OmitUserLogField {
+				if sub, _ := claims["sub"].(string); sub != "" {
+					LogEntrySetField(r, "user", sub)
+				}
+			}
+			// with no mapping configured, move to the next middleware
+			if len(claimToContextKeyMapping) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
 			if !ok || claims == nil {
 				render.Render(w, r, ErrAuth(errors.New("claims not found in auth token in Context()")))
 				return
@@ -31,8 +103,11 @@ func NewContextSetter(claimToContextKeyMapping map[string]interface{}) func(http
 
 			ctx := r.Context()
 			for claimKey, contextKey := range claimToContextKeyMapping {
-				claim, found := claims[claimKey]
+				claim, found := lookupClaim(claims, claimKey)
 				if !found {
+					if options.SkipMissingClaims || optional[claimKey] {
+						continue
+					}
 					render.Render(w, r, ErrAuth(fmt.Errorf("%s claim not found in claims", claimKey)))
 					return
 				}
@@ -0,0 +1,169 @@
+package middleware_test
+
+import (
+	"context"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/piontec/go-chi-middleware-server/pkg/server/middleware"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func serveContextSetter(mapping map[string]interface{}, claims jwt.MapClaims, keys ...interface{}) (int, []interface{}) {
+	var values []interface{}
+	handler := middleware.NewContextSetter(mapping)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, key := range keys {
+			values = append(values, r.Context().Value(key))
+		}
+	}))
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	req := httptest.NewRequest("GET", "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), middleware.CtxJWTKey, token))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code, values
+}
+
+func TestContextSetterNestedClaims(t *testing.T) {
+	claims := jwt.MapClaims{
+		"sub": "alice",
+		"address": map[string]interface{}{
+			"country": "PL",
+			"geo":     map[string]interface{}{"city": "Warsaw"},
+		},
+		"https://example.com/tenant": "acme",
+	}
+	mapping := map[string]interface{}{
+		"sub":                        "user",
+		"address.country":            "country",
+		"address.geo.city":           "city",
+		"https://example.com/tenant": "tenant",
+	}
+	code, values := serveContextSetter(mapping, claims, "user", "country", "city", "tenant")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []interface{}{"alice", "PL", "Warsaw", "acme"}, values)
+
+	for _, missing := range []string{"address.zip", "address.geo.street", "address.country.code", "phone.number"} {
+		code, _ = serveContextSetter(map[string]interface{}{missing: "value"}, claims)
+		assert.Equal(t, http.StatusUnauthorized, code, missing)
+	}
+}
+
+func TestContextSetterMissingClaims(t *testing.T) {
+	mapping := map[string]interface{}{"sub": "user", "email": "email", "tenant": "tenant"}
+	claims := jwt.MapClaims{"sub": "alice"}
+	serve := func(options middleware.ContextSetterOptions) (int, []interface{}) {
+		var values []interface{}
+		options.ClaimToContextKeyMapping = mapping
+		handler := middleware.NewContextSetterWithOptions(options)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			values = []interface{}{r.Context().Value("user"), r.Context().Value("email"), r.Context().Value("tenant")}
+		}))
+		req := httptest.NewRequest("GET", "/", nil)
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		req = req.WithContext(context.WithValue(req.Context(), middleware.CtxJWTKey, token))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code, values
+	}
+
+	code, _ := serve(middleware.ContextSetterOptions{})
+	assert.Equal(t, http.StatusUnauthorized, code, "missing claims are required by default")
+
+	code, values := serve(middleware.ContextSetterOptions{SkipMissingClaims: true})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []interface{}{"alice", nil, nil}, values)
+
+	code, _ = serve(middleware.ContextSetterOptions{OptionalClaims: []string{"email"}})
+	assert.Equal(t, http.StatusUnauthorized, code, "tenant is still required")
+
+	code, values = serve(middleware.ContextSetterOptions{OptionalClaims: []string{"email", "tenant"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []interface{}{"alice", nil, nil}, values)
+}
+
+func TestContextSetterTypedKeys(t *testing.T) {
+	emailKey := middleware.ContextKey("email")
+	var values []interface{}
+	handler := middleware.NewContextSetter(map[string]interface{}{
+		"email":          emailKey,
+		"groups":         middleware.ContextKey("groups"),
+		"email_verified": middleware.ContextKey("email_verified"),
+		"age":            middleware.ContextKey("age"),
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		email, emailOK := middleware.GetClaimString(ctx, emailKey)
+		groups, groupsOK := middleware.GetClaimStrings(ctx, middleware.ContextKey("groups"))
+		verified, verifiedOK := middleware.GetClaimBool(ctx, middleware.ContextKey("email_verified"))
+		age, ageOK := middleware.GetClaimNumber(ctx, middleware.ContextKey("age"))
+		_, wrongTypeOK := middleware.GetClaimString(ctx, middleware.ContextKey("age"))
+		values = []interface{}{email, emailOK, groups, groupsOK, verified, verifiedOK, age, ageOK, wrongTypeOK,
+			ctx.Value("email")}
+	}))
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"email":          "alice@example.com",
+		"groups":         []interface{}{"dev", "ops"},
+		"email_verified": true,
+		"age":            float64(42),
+	})
+	req := httptest.NewRequest("GET", "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), middleware.CtxJWTKey, token))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []interface{}{"alice@example.com", true, []string{"dev", "ops"}, true, true, true, float64(42), true,
+		false, nil}, values, "typed keys must not be readable with plain string keys")
+}
+
+func TestContextSetterReadsAuthenticatedToken(t *testing.T) {
+	key := newTestKey(t)
+	jwksServer := newJwksTestServer(map[string]*rsa.PublicKey{"kid-1": &key.PublicKey})
+	defer jwksServer.Close()
+	auth := middleware.NewJWTAuthenticator(testAudience, testIssuer, jwksServer.URL, nil)
+
+	var email, user interface{}
+	handler := auth.GetHandler()(
+		middleware.NewContextSetter(map[string]interface{}{"email": middleware.ContextKey("email")})(
+			middleware.NewUserInfoSetter("", "", "")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				email = r.Context().Value(middleware.ContextKey("email"))
+				user = r.Context().Value(middleware.CtxUserKey)
+			}))))
+	claims := testClaims(time.Hour)
+	claims["email"] = "test-user@example.com"
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+signTestToken(t, key, "kid-1", claims))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "test-user@example.com", email)
+	assert.Equal(t, "test-user", user)
+}
+
+func TestAuthenticatorStoresTokenUnderCtxJWTKey(t *testing.T) {
+	key := newTestKey(t)
+	jwksServer := newJwksTestServer(map[string]*rsa.PublicKey{"kid-1": &key.PublicKey})
+	defer jwksServer.Close()
+	auth := middleware.NewJWTAuthenticator(testAudience, testIssuer, jwksServer.URL, nil)
+
+	var stored interface{}
+	var token *jwt.Token
+	var found bool
+	handler := auth.GetHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stored = r.Context().Value(middleware.CtxJWTKey)
+		token, found = middleware.GetToken(r)
+	}))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+signTestToken(t, key, "kid-1", testClaims(time.Hour)))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.IsType(t, &jwt.Token{}, stored)
+	assert.True(t, found, "setters must read the token from the key the authenticator stores it under")
+	assert.Equal(t, stored, token)
+	assert.Equal(t, "jwt_token", middleware.CtxJWTKey)
+}
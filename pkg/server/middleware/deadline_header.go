@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/render"
+)
+
+// grpcTimeoutUnits maps units of the gRPC 'grpc-timeout' header to durations
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// NewDeadlineHeader returns a middleware, which sets the request context deadline to the
+// time budget the client sent in the header, so downstream work is cancelled once the
+// client stops waiting. Like chi's Timeout middleware, it answers with 504 if the deadline
+// was hit, and handlers must watch r.Context().Done() to actually stop their work.
+// The value can use the 'grpc-timeout' format, like "500m", a Go duration, like "1.5s", or
+// a whole number of seconds. Requests without the header are passed through unchanged, and
+// requests with an invalid value are rejected with 400. An earlier deadline, e.g. set by
+// the Timeout middleware, is kept.
+func NewDeadlineHeader(header string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			value := r.Header.Get(header)
+			if value == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			timeout, err := parseDeadlineHeader(value)
+			if err != nil {
+				render.Render(w, r, ErrInvalidRequest(err))
+				return
+			}
+			if timeout <= 0 {
+				w.WriteHeader(http.StatusGatewayTimeout)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer func() {
+				cancel()
+				if ctx.Err() == context.DeadlineExceeded {
+					w.WriteHeader(http.StatusGatewayTimeout)
+				}
+			}()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// parseDeadlineHeader parses the 'grpc-timeout' format, Go durations and whole seconds
+func parseDeadlineHeader(value string) (time.Duration, error) {
+	if n := len(value); n >= 2 && n <= 9 {
+		if unit, found := grpcTimeoutUnits[value[n-1]]; found {
+			if amount, err := strconv.ParseUint(value[:n-1], 10, 64); err == nil {
+				return time.Duration(amount) * unit, nil
+			}
+		}
+	}
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	if timeout, err := time.ParseDuration(value); err == nil {
+		return timeout, nil
+	}
+	return 0, errors.New("invalid request deadline header")
+}
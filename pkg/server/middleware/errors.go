@@ -3,10 +3,13 @@ package middleware
 import (
 	"net/http"
 
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
 )
 
-// ErrResponse renderer type for handling all sorts of errors.
+// ErrResponse renderer type for handling all sorts of errors. The Err* functions below
+// return it for common cases, so application handlers can respond with the same JSON
+// errors as the server's middleware, e.g. render.Render(w, r, msm.ErrResourceNotFound(err)).
 //
 // In the best case scenario, the excellent github.com/pkg/errors package
 // helps reveal information on the error, setting it on Err, and in the Render()
@@ -15,18 +18,23 @@ type ErrResponse struct {
 	Err            error `json:"-"` // low-level runtime error
 	HTTPStatusCode int   `json:"-"` // http response status code
 
-	StatusText string `json:"status"`          // user-level status message
-	AppCode    int64  `json:"code,omitempty"`  // application-specific error code
-	ErrorText  string `json:"error,omitempty"` // application-level error message, for debugging
+	StatusText string `json:"status"`               // user-level status message
+	AppCode    int64  `json:"code,omitempty"`       // application-specific error code
+	ErrorText  string `json:"error,omitempty"`      // application-level error message, for debugging
+	RequestID  string `json:"request_id,omitempty"` // ID of the request, if the RequestID middleware is used
 }
 
 // Render returns rendered error response
 func (e *ErrResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	// ErrNotFound is shared by all requests, so it can't carry their IDs
+	if e.RequestID == "" && e != ErrNotFound {
+		e.RequestID = middleware.GetReqID(r.Context())
+	}
 	render.Status(r, e.HTTPStatusCode)
 	return nil
 }
 
-// ErrInvalidRequest is returned for invalid requests
+// ErrInvalidRequest is returned for invalid requests; it's the same as ErrBadRequest
 func ErrInvalidRequest(err error) render.Renderer {
 	return &ErrResponse{
 		Err:            err,
@@ -36,6 +44,11 @@ func ErrInvalidRequest(err error) render.Renderer {
 	}
 }
 
+// ErrBadRequest is returned for invalid requests
+func ErrBadRequest(err error) render.Renderer {
+	return ErrInvalidRequest(err)
+}
+
 // ErrRender is returned when there was rendering error
 func ErrRender(err error) render.Renderer {
 	return &ErrResponse{
@@ -56,8 +69,83 @@ func ErrAuth(err error) render.Renderer {
 	}
 }
 
-// ErrNotFound - guess when it's returned
+// ErrForbidden is returned when the authenticated user isn't allowed to perform the request
+func ErrForbidden(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 403,
+		StatusText:     "Forbidden.",
+		ErrorText:      err.Error(),
+	}
+}
+
+// ErrMethodNotAllowed is returned when the HTTP method of the request is not allowed
+func ErrMethodNotAllowed(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 405,
+		StatusText:     "Method not allowed.",
+		ErrorText:      err.Error(),
+	}
+}
+
+// ErrRequestTooLarge is returned when the request body is larger than allowed
+func ErrRequestTooLarge(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 413,
+		StatusText:     "Request entity too large.",
+		ErrorText:      err.Error(),
+	}
+}
+
+// ErrUnsupportedMediaType is returned when the request body has an unsupported Content-Type
+func ErrUnsupportedMediaType(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 415,
+		StatusText:     "Unsupported media type.",
+		ErrorText:      err.Error(),
+	}
+}
+
+// ErrTooManyRequests is returned when the client sent too many requests
+func ErrTooManyRequests(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 429,
+		StatusText:     "Too many requests.",
+		ErrorText:      err.Error(),
+	}
+}
+
+// ErrNotFound - guess when it's returned. It's kept for compatibility; use ErrResourceNotFound
+// to include the error message and the request ID in the response.
 var ErrNotFound = &ErrResponse{
 	HTTPStatusCode: 404,
 	StatusText:     "Resource not found.",
 }
+
+// ErrResourceNotFound is returned when the requested resource doesn't exist; err can be nil
+func ErrResourceNotFound(err error) render.Renderer {
+	e := &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 404,
+		StatusText:     "Resource not found.",
+	}
+	if err != nil {
+		e.ErrorText = err.Error()
+	}
+	return e
+}
+
+// ErrInternal is returned when the request failed because of a server side error. The
+// error message isn't sent to the client, as it may reveal internal details.
+func ErrInternal(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 500,
+		StatusText:     "Internal server error.",
+		ErrorText:      "internal server error",
+	}
+}
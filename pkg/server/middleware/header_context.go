@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+)
+
+// CtxHeaderValuesKey allows to get values of headers copied to Context() by the
+// HeaderContext middleware, as map[string]string keyed by canonical header names
+const CtxHeaderValuesKey = "header_values"
+
+// NewHeaderContext returns a middleware, which copies values of the named request headers,
+// like `X-Ctx-Tenant` or `X-Ctx-Locale`, to the request's Context() under CtxHeaderValuesKey
+// and adds them to the request log entry as "header_<name>" fields. Values of sensitive
+// headers, like Authorization or X-Api-Key, are logged as RedactedHeaderValue, like by the
+// structured logger. Use GetHeaderValue to read them in handlers.
+func NewHeaderContext(headers []string) func(next http.Handler) http.Handler {
+	names := make([]string, 0, len(headers))
+	for _, name := range headers {
+		names = append(names, http.CanonicalHeaderKey(name))
+	}
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			values := make(map[string]string, len(names))
+			fields := make(map[string]interface{}, len(names))
+			for _, name := range names {
+				if value := r.Header.Get(name); value != "" {
+					values[name] = value
+					if sensitiveHeaders[name] {
+						value = RedactedHeaderValue
+					}
+					fields[headerFieldName(name)] = value
+				}
+			}
+			if len(values) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			LogEntrySetFields(r, fields)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), CtxHeaderValuesKey, values)))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// GetHeaderValues returns all header values copied to the context by the HeaderContext middleware
+func GetHeaderValues(ctx context.Context) map[string]string {
+	values, _ := ctx.Value(CtxHeaderValuesKey).(map[string]string)
+	return values
+}
+
+// GetHeaderValue returns the value of the named header copied to the context by the
+// HeaderContext middleware, or an empty string if it wasn't sent
+func GetHeaderValue(ctx context.Context, name string) string {
+	return GetHeaderValues(ctx)[http.CanonicalHeaderKey(name)]
+}
@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/go-chi/render"
+)
+
+const (
+	// LivenessPath is the path of the liveness endpoint
+	LivenessPath = "/livez"
+	// ReadinessPath is the path of the readiness endpoint
+	ReadinessPath = "/readyz"
+)
+
+// ReadinessChecks maps check names to functions verifying the service is ready to serve
+// requests, e.g. by pinging a database
+type ReadinessChecks map[string]func(context.Context) error
+
+// HealthStatus is the JSON body returned by liveness and readiness endpoints
+type HealthStatus struct {
+	Status       string            `json:"status"`
+	FailedChecks map[string]string `json:"failed_checks,omitempty"`
+}
+
+// NewHealthChecks returns a middleware serving GET requests to the liveness and readiness
+// endpoints. The liveness endpoint always returns 200, while the readiness endpoint runs
+// all the checks and returns 503 listing the failing ones, or 200 if all of them passed.
+func NewHealthChecks(checks ReadinessChecks) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				next.ServeHTTP(w, r)
+				return
+			}
+			switch r.URL.Path {
+			case LivenessPath:
+				render.JSON(w, r, &HealthStatus{Status: "alive"})
+			case ReadinessPath:
+				failed := runReadinessChecks(r.Context(), checks)
+				if len(failed) > 0 {
+					render.Status(r, http.StatusServiceUnavailable)
+					render.JSON(w, r, &HealthStatus{Status: "not ready", FailedChecks: failed})
+					return
+				}
+				render.JSON(w, r, &HealthStatus{Status: "ready"})
+			default:
+				next.ServeHTTP(w, r)
+			}
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// runReadinessChecks runs all the checks concurrently and returns errors of the failed ones
+func runReadinessChecks(ctx context.Context, checks ReadinessChecks) map[string]string {
+	lock := sync.Mutex{}
+	failed := map[string]string{}
+	wg := sync.WaitGroup{}
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+			if err := check(ctx); err != nil {
+				lock.Lock()
+				failed[name] = err.Error()
+				lock.Unlock()
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	return failed
+}
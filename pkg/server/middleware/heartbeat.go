@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const (
+	// DefaultHeartbeatPath is the default path of the heartbeat endpoint
+	DefaultHeartbeatPath = "/ping"
+	// DefaultHeartbeatBody is the default response body of the heartbeat endpoint
+	DefaultHeartbeatBody = "."
+)
+
+// NewHeartbeat returns a middleware answering GET and HEAD requests to path with 200 and
+// body, like chi's Heartbeat, but with a configurable path and body. If body is a JSON
+// object or array, it's sent as application/json, otherwise as text/plain. Empty path and
+// body fall back to the defaults.
+func NewHeartbeat(path, body string) func(next http.Handler) http.Handler {
+	if path == "" {
+		path = DefaultHeartbeatPath
+	}
+	if body == "" {
+		body = DefaultHeartbeatBody
+	}
+	contentType := "text/plain"
+	trimmed := strings.TrimSpace(body)
+	if (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed)) {
+		contentType = "application/json"
+	}
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if (r.Method == http.MethodGet || r.Method == http.MethodHead) && strings.EqualFold(r.URL.Path, path) {
+				w.Header().Set("Content-Type", contentType)
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte(body))
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/render"
+)
+
+const (
+	// DefaultSignatureHeader is the header with the request signature used by GitHub webhooks
+	DefaultSignatureHeader = "X-Hub-Signature-256"
+	// signaturePrefix is the optional prefix of the hex encoded signature, as sent by GitHub
+	signaturePrefix = "sha256="
+	// DefaultSignedBodyMaxBytes is the default limit of signed request bodies, the maximum
+	// size of GitHub webhook payloads
+	DefaultSignedBodyMaxBytes = 25 << 20
+)
+
+// HMACSignatureOptions configures the HMACSignatureVerifier middleware
+type HMACSignatureOptions struct {
+	// Secret the signatures are computed with
+	Secret []byte
+	// Header with the signature; defaults to DefaultSignatureHeader
+	Header string
+	// MaxBodyBytes limits the size of the body buffered to verify its signature; larger
+	// requests are rejected with 413. Defaults to DefaultSignedBodyMaxBytes.
+	MaxBodyBytes int64
+}
+
+// NewHMACSignatureVerifier returns a middleware, which verifies that the signatureHeader
+// of the request contains the hex encoded HMAC-SHA256 of the raw request body, computed
+// with the secret. The value can be prefixed with "sha256=", like in GitHub webhooks.
+// Requests without a valid signature are rejected with 401. The body is buffered, so
+// handlers can still read it; bodies larger than DefaultSignedBodyMaxBytes are rejected
+// with 413. If signatureHeader is empty, DefaultSignatureHeader is used.
+func NewHMACSignatureVerifier(secret []byte, signatureHeader string) func(next http.Handler) http.Handler {
+	return NewHMACSignatureVerifierWithOptions(HMACSignatureOptions{Secret: secret, Header: signatureHeader})
+}
+
+// NewHMACSignatureVerifierWithOptions returns the HMACSignatureVerifier middleware configured
+// with HMACSignatureOptions
+func NewHMACSignatureVerifierWithOptions(options HMACSignatureOptions) func(next http.Handler) http.Handler {
+	secret := options.Secret
+	signatureHeader := options.Header
+	if signatureHeader == "" {
+		signatureHeader = DefaultSignatureHeader
+	}
+	maxBytes := options.MaxBodyBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultSignedBodyMaxBytes
+	}
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get(signatureHeader)
+			if header == "" {
+				render.Render(w, r, ErrAuth(fmt.Errorf("%s header with request signature not found", signatureHeader)))
+				return
+			}
+			signature, err := hex.DecodeString(strings.TrimPrefix(header, signaturePrefix))
+			if err != nil {
+				render.Render(w, r, ErrAuth(errors.New("request signature is not hex encoded")))
+				return
+			}
+
+			if r.ContentLength > maxBytes {
+				render.Render(w, r, ErrRequestTooLarge(fmt.Errorf("request body is larger than %d bytes", maxBytes)))
+				return
+			}
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBytes))
+			r.Body.Close()
+			// the reader fails after returning exactly maxBytes when the body is larger
+			if err != nil && int64(len(body)) == maxBytes {
+				render.Render(w, r, ErrRequestTooLarge(fmt.Errorf("request body is larger than %d bytes", maxBytes)))
+				return
+			}
+			if err != nil {
+				render.Render(w, r, ErrInvalidRequest(fmt.Errorf("can't read request body: %v", err)))
+				return
+			}
+			mac := hmac.New(sha256.New, secret)
+			mac.Write(body)
+			if !hmac.Equal(signature, mac.Sum(nil)) {
+				render.Render(w, r, ErrAuth(errors.New("request signature is invalid")))
+				return
+			}
+
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
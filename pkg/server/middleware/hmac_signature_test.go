@@ -0,0 +1,78 @@
+package middleware_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/piontec/go-chi-middleware-server/pkg/server/middleware"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHMACSignatureVerifier(t *testing.T) {
+	secret := []byte("webhook-secret")
+	payload := `{"action":"opened"}`
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	validSignature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	handler := middleware.NewHMACSignatureVerifier(secret, "")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	send := func(signature string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/webhook", strings.NewReader(payload))
+		if signature != "" {
+			req.Header.Set(middleware.DefaultSignatureHeader, signature)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := send(validSignature)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, payload, rec.Body.String(), "handler must be able to read the verified body")
+
+	// signature without the prefix is accepted as well
+	assert.Equal(t, http.StatusOK, send(strings.TrimPrefix(validSignature, "sha256=")).Code)
+
+	rec = send("sha256=" + strings.Repeat("0", 64))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), "request signature is invalid")
+
+	rec = send("")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), "X-Hub-Signature-256 header with request signature not found")
+}
+
+func TestHMACSignatureVerifierBodyLimit(t *testing.T) {
+	secret := []byte("webhook-secret")
+	handler := middleware.NewHMACSignatureVerifierWithOptions(middleware.HMACSignatureOptions{
+		Secret:       secret,
+		MaxBodyBytes: 8,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	send := func(payload string, chunked bool) int {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(payload))
+		req := httptest.NewRequest("POST", "/webhook", strings.NewReader(payload))
+		if chunked {
+			req.ContentLength = -1
+		}
+		req.Header.Set(middleware.DefaultSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send("12345678", false))
+	assert.Equal(t, http.StatusOK, send("12345678", true))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, send("123456789", false))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, send("123456789", true), "body without Content-Length must be limited too")
+}
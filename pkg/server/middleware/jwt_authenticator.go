@@ -2,27 +2,32 @@ package middleware
 
 import (
 	"bytes"
+	"context"
 	"crypto/rsa"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/big"
+	"mime"
 	"net/http"
+	"regexp"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"time"
 
 	jwtmiddleware "github.com/auth0/go-jwt-middleware"
-	"github.com/form3tech-oss/jwt-go"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/golang-jwt/jwt"
+	"github.com/sirupsen/logrus"
 )
 
-const (
-	// CtxJWTKey allows to get JWT token
-	CtxJWTKey = "jwt_token"
-	// ClaimUserKey JWT token claim with subject name
-	// ClaimUserKey = "sub"
-)
+const modulePath = "github.com/piontec/go-chi-middleware-server"
 
 type jwks struct {
 	Keys []jsonWebKey `json:"keys"`
@@ -40,152 +45,910 @@ type jsonWebKey struct {
 
 // JwtAuthenticator is a middleware for validating JWT auth tokens
 type JwtAuthenticator struct {
-	audience       string
+	audiences      []string
+	skipAudience   bool
+	allowNoAud     bool
 	issuer         string
+	allowNoIss     bool
 	jwksURL        string
 	publicPrefixes []string
+	publicRegexps  []*regexp.Regexp
+	publicURLs     []PublicURL
+	clockSkew      time.Duration
 	loader         *JwksKeyLoader
+	cache          *tokenCache
+	logLatency     bool
+	tokenTypes     map[string]bool
+	allowNoType    bool
+	validators     []func(jwt.MapClaims) error
+	introspector   *tokenIntrospector
+	clock          func() time.Time
+	routes         chi.Routes
+	routesOnce     sync.Once
+	publicRoutes   map[string]bool
+}
+
+// JWTAuthenticatorOptions configures JwtAuthenticator
+type JWTAuthenticatorOptions struct {
+	// Audience expected in the 'aud' claim of JWT tokens
+	Audience string
+	// Audiences lists more accepted audiences; a token is accepted when its 'aud' claim,
+	// a string or an array, contains Audience or any of Audiences
+	Audiences []string
+	// SkipAudienceCheck disables validation of the 'aud' claim, for providers and flows
+	// that don't set the audience; tokens are then validated only by their issuer and
+	// signature, and Audience is ignored
+	SkipAudienceCheck bool
+	// AllowMissingAudience accepts tokens without the 'aud' claim; by default they're rejected
+	AllowMissingAudience bool
+	// Issuer expected in the 'iss' claim of JWT tokens
+	Issuer string
+	// AllowMissingIssuer accepts tokens without the 'iss' claim; by default they're rejected
+	AllowMissingIssuer bool
+	// JwksURL is the URL of the JWKS document with keys used to sign JWT tokens
+	JwksURL string
+	// JwksFile is used instead of JwksURL, see JwksKeyLoaderOptions
+	JwksFile string
+	// JwksInline is used instead of JwksURL, see JwksKeyLoaderOptions
+	JwksInline string
+	// PublicURLPrefixes lists path prefixes, which don't require authentication. A prefix
+	// matches whole path segments: "/pub" matches "/pub" and "/pub/docs", but not "/public".
+	// A prefix ending with "/", like "/pub/", matches only paths below it.
+	PublicURLPrefixes []string
+	// PublicURLPatterns lists regular expressions of paths, which don't require authentication.
+	// They're matched against the whole escaped path, so they should be anchored, like
+	// ^/users/[^/]+/public$, unless matching anywhere in the path is intended.
+	PublicURLPatterns []*regexp.Regexp
+	// PublicURLs lists path prefixes, which don't require authentication only for some methods
+	PublicURLs []PublicURL
+	// ClockSkew is the leeway allowed when validating 'exp', 'nbf' and 'iat' claims, so
+	// that tokens issued by servers with slightly skewed clocks are accepted. It's rounded
+	// down to whole seconds. Be careful: a very large skew effectively disables the expiry
+	// check, as tokens stay valid for ClockSkew after they expire.
+	ClockSkew time.Duration
+	// TokenCacheSize enables caching of up to TokenCacheSize successfully validated tokens,
+	// so repeated requests with the same token skip signature verification until the token
+	// expires. Tokens without the 'exp' claim are never cached. Zero disables the cache.
+	TokenCacheSize int
+	// LogLatency adds the time spent validating the token as `auth_latency_ms` field to the
+	// request log entry
+	LogLatency bool
+	// AllowedTokenTypes lists accepted values of the 'typ' header of JWT tokens, like "at+jwt"
+	// for access tokens, to protect against token type confusion. Values are compared case
+	// insensitively and the "application/" prefix is ignored. Empty list disables the check.
+	AllowedTokenTypes []string
+	// AllowMissingTokenType accepts tokens without the 'typ' header when AllowedTokenTypes is set
+	AllowMissingTokenType bool
+	// ClaimValidators enforce custom rules on the token's claims, like an allow-list of
+	// tenants. They run in order after the signature, audience, issuer and time claims are
+	// verified, so they only see claims of authentic tokens; the first non-nil error rejects
+	// the token with 401 and is sent to the client as the error message.
+	ClaimValidators []func(jwt.MapClaims) error
+	// JwksUserAgent is the User-Agent sent when fetching the JWKS document; defaults to DefaultJwksUserAgent()
+	JwksUserAgent string
+	// JwksRequestHeaders are additional headers sent when fetching the JWKS document
+	JwksRequestHeaders map[string]string
+	// JwksHTTPClient is used to fetch the JWKS document, see JwksKeyLoaderOptions; it's also
+	// used for token introspection
+	JwksHTTPClient *http.Client
+	// Clock returns the current time used to validate time claims and expire cached tokens;
+	// defaults to jwt.TimeFunc. It's meant for tests, which need to move the time.
+	Clock func() time.Time
+	// IntrospectionURL enables validation of opaque tokens with the introspection endpoint of
+	// the provider (RFC 7662) instead of JWT validation with the JWKS keys. Active tokens are
+	// checked for audience, issuer, custom claims and time claims like JWT tokens and then
+	// cached until their expiry: TokenCacheSize defaults to DefaultIntrospectionCacheSize and
+	// a negative value disables the cache. Tokens revoked in the meantime stay accepted from
+	// the cache. Inactive tokens and failed introspections aren't cached; if the endpoint can't
+	// be reached, requests with tokens not in the cache are rejected with 401.
+	IntrospectionURL string
+	// ClientID authenticates the introspection requests with HTTP Basic auth, with ClientSecret
+	ClientID string
+	// ClientSecret is the secret of ClientID
+	ClientSecret string
+}
+
+// PublicURL is a path prefix, which doesn't require authentication for the listed HTTP
+// methods, like GET requests of a public read API with authenticated writes. Prefix is
+// matched like PublicURLPrefixes and empty Methods make the prefix public for all methods.
+type PublicURL struct {
+	Prefix  string
+	Methods []string
+}
+
+// matches checks if the request's method and path are public
+func (p PublicURL) matches(method, urlPath string) bool {
+	if !hasPathPrefix(urlPath, p.Prefix) {
+		return false
+	}
+	if len(p.Methods) == 0 {
+		return true
+	}
+	for _, m := range p.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
 }
 
 // NewJWTAuthenticator returns a new authenticator for the given audience and issuer values
 // expected in JWT tokens
 func NewJWTAuthenticator(audience, issuer, jwksURL string, publicURLPrefixes []string) *JwtAuthenticator {
-	return &JwtAuthenticator{
-		audience:       audience,
-		issuer:         issuer,
-		jwksURL:        jwksURL,
-		publicPrefixes: publicURLPrefixes,
-		loader:         NewJwksKeyLoader(jwksURL),
+	return NewJWTAuthenticatorWithOptions(JWTAuthenticatorOptions{
+		Audience:          audience,
+		Issuer:            issuer,
+		JwksURL:           jwksURL,
+		PublicURLPrefixes: publicURLPrefixes,
+	})
+}
+
+// NewJWTAuthenticatorWithOptions returns a new authenticator configured with JWTAuthenticatorOptions
+func NewJWTAuthenticatorWithOptions(options JWTAuthenticatorOptions) *JwtAuthenticator {
+	a := &JwtAuthenticator{
+		audiences:      acceptedAudiences(options.Audience, options.Audiences),
+		skipAudience:   options.SkipAudienceCheck,
+		allowNoAud:     options.AllowMissingAudience,
+		issuer:         options.Issuer,
+		allowNoIss:     options.AllowMissingIssuer,
+		jwksURL:        options.JwksURL,
+		publicPrefixes: options.PublicURLPrefixes,
+		publicRegexps:  options.PublicURLPatterns,
+		publicURLs:     options.PublicURLs,
+		clockSkew:      options.ClockSkew,
+		loader: NewJwksKeyLoaderWithOptions(JwksKeyLoaderOptions{
+			JwksURL:        options.JwksURL,
+			JwksFile:       options.JwksFile,
+			JwksInline:     options.JwksInline,
+			UserAgent:      options.JwksUserAgent,
+			RequestHeaders: options.JwksRequestHeaders,
+			HTTPClient:     options.JwksHTTPClient,
+		}),
+		logLatency:  options.LogLatency,
+		allowNoType: options.AllowMissingTokenType,
+		validators:  options.ClaimValidators,
+		clock:       options.Clock,
 	}
+	if len(options.AllowedTokenTypes) > 0 {
+		a.tokenTypes = make(map[string]bool, len(options.AllowedTokenTypes))
+		for _, typ := range options.AllowedTokenTypes {
+			a.tokenTypes[normalizeTokenType(typ)] = true
+		}
+	}
+	cacheSize := options.TokenCacheSize
+	if options.IntrospectionURL != "" {
+		client := options.JwksHTTPClient
+		if client == nil {
+			client = &http.Client{Timeout: DefaultJwksTimeout}
+		}
+		a.introspector = &tokenIntrospector{
+			url:          options.IntrospectionURL,
+			clientID:     options.ClientID,
+			clientSecret: options.ClientSecret,
+			userAgent:    a.loader.userAgent,
+			client:       client,
+		}
+		if cacheSize == 0 {
+			cacheSize = DefaultIntrospectionCacheSize
+		}
+	}
+	if cacheSize > 0 {
+		a.cache = newTokenCache(cacheSize)
+	}
+	return a
+}
+
+// acceptedAudiences merges the single audience with the list of audiences
+func acceptedAudiences(audience string, audiences []string) []string {
+	result := make([]string, 0, len(audiences)+1)
+	if audience != "" {
+		result = append(result, audience)
+	}
+	for _, aud := range audiences {
+		if aud != "" {
+			result = append(result, aud)
+		}
+	}
+	return result
 }
 
 func (a *JwtAuthenticator) getRSAPublicKeyByID(keyID string) (*rsa.PublicKey, error) {
-	keyCopy, err := a.loader.GetPublicKey(keyID)
-	// key loading can fail because of cert expiry and renewal; try to reload in that case
+	// the loader reloads the keys by itself when it doesn't know the requested key ID
+	key, err := a.loader.GetPublicKey(keyID)
+	if err == errKeyNotFound {
+		return nil, &AuthError{Reason: AuthReasonKeyNotFound, Err: err}
+	}
 	if err != nil {
-		a.loader.Reload()
-		keyCopy, reloadErr := a.loader.GetPublicKey(keyID)
-		if reloadErr != nil {
-			return nil, fmt.Errorf("can't load public key for JWT validation: %v", reloadErr)
-		}
-		return keyCopy, nil
+		return nil, &AuthError{Reason: AuthReasonKeyUnavailable, Err: fmt.Errorf("can't load public key for JWT validation: %v", err)}
 	}
+	return key, nil
+}
 
-	return keyCopy, nil
+// StartKeyRefresh starts periodic background refresh of the JWKS keys used for validation
+func (a *JwtAuthenticator) StartKeyRefresh(interval time.Duration, logger logrus.FieldLogger) {
+	a.loader.StartRefresh(interval, logger)
 }
 
-// GetHandler returns new middleware handler
+// ReloadKeys makes the next validation needing a key reload the JWKS keys, e.g. after the
+// provider rotated them
+func (a *JwtAuthenticator) ReloadKeys() {
+	a.loader.Reload()
+}
+
+// now returns the current time of the configured clock
+func (a *JwtAuthenticator) now() time.Time {
+	if a.clock != nil {
+		return a.clock()
+	}
+	return jwt.TimeFunc()
+}
+
+// StopKeyRefresh stops the background refresh of JWKS keys started with StartKeyRefresh
+func (a *JwtAuthenticator) StopKeyRefresh() {
+	a.loader.StopRefresh()
+}
+
+// GetHandler returns new middleware handler. The token is validated for every request,
+// also on reused keep-alive connections, so the token and values derived from its claims
+// are never put into the request's Context() after the token expires. Failures are
+// rendered with ErrAuth and logged as the `auth_error` and `auth_error_reason` fields.
 func (a *JwtAuthenticator) GetHandler() func(next http.Handler) http.Handler {
-	jwtMiddleware := jwtmiddleware.New(jwtmiddleware.Options{
-		ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
-			// Verify 'aud' claim
-			checkAud := token.Claims.(jwt.MapClaims).VerifyAudience(a.audience, false)
-			if !checkAud {
-				return token, errors.New("invalid audience")
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			// if this URL is public, it's a preflight request or the request was already
+			// authenticated with another scheme, skip auth path
+			if _, authenticated := GetAuthScheme(r); authenticated || a.isPublic(r) || r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
 			}
-			// Verify 'iss' claim
-			checkIss := token.Claims.(jwt.MapClaims).VerifyIssuer(a.issuer, false)
-			if !checkIss {
-				return token, errors.New("invalid issuer")
+
+			start := time.Now()
+			token, err := a.checkJWT(r)
+			if a.logLatency {
+				LogEntrySetField(r, "auth_latency_ms", float64(time.Since(start).Nanoseconds())/1000000.0)
 			}
-			// Load required RSA public key
-			keyID := token.Header["kid"].(string)
-			key, err := a.getRSAPublicKeyByID(keyID)
 			if err != nil {
-				return token, err
+				LogEntrySetFields(r, map[string]interface{}{"auth_error": err.Error(), "auth_error_reason": err.Reason.String()})
+				err.setWWWAuthenticate(w)
+				render.Render(w, r, ErrAuth(errors.New(err.clientMessage())))
+				return
 			}
-			return key, err
-		},
-		SigningMethod: jwt.SigningMethodRS256,
-		UserProperty:  CtxJWTKey,
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), CtxJWTKey, token)))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// isPublic checks if the request's path and method are configured as public
+func (a *JwtAuthenticator) isPublic(r *http.Request) bool {
+	urlPath := r.URL.EscapedPath()
+	for _, prefix := range a.publicPrefixes {
+		if hasPathPrefix(urlPath, prefix) {
+			return true
+		}
+	}
+	for _, re := range a.publicRegexps {
+		if re.MatchString(urlPath) {
+			return true
+		}
+	}
+	for _, publicURL := range a.publicURLs {
+		if publicURL.matches(r.Method, urlPath) {
+			return true
+		}
+	}
+	return a.isPublicRoute(r)
+}
+
+// SetRoutes lets the authenticator find routes marked with Public or PublicRoute in the
+// router, so they don't require authentication. The routes are collected on the first
+// request, so all of them have to be registered before serving.
+func (a *JwtAuthenticator) SetRoutes(routes chi.Routes) {
+	a.routes = routes
+}
+
+// isPublicRoute checks if the request is routed to a route marked as public
+func (a *JwtAuthenticator) isPublicRoute(r *http.Request) bool {
+	if a.routes == nil {
+		return false
+	}
+	a.routesOnce.Do(func() {
+		a.publicRoutes = publicRoutes(a.routes)
 	})
+	if len(a.publicRoutes) == 0 {
+		return false
+	}
+	pattern, found := matchedRoutePattern(a.routes, r)
+	return found && a.publicRoutes[r.Method+" "+pattern]
+}
 
-	return func(next http.Handler) http.Handler {
-		fn := func(w http.ResponseWriter, r *http.Request) {
-			// check if this is a public path that requires no authentication
-			isPublic := false
-			for _, prefix := range a.publicPrefixes {
-				urlPath := r.URL.EscapedPath()
-				if strings.HasPrefix(urlPath, prefix) {
-					isPublic = true
-					break
-				}
-			}
-			if isPublic { // if this URL is public, skip auth path
-				next.ServeHTTP(w, r)
-			} else {
-				jwtMiddleware.Handler(next).ServeHTTP(w, r)
-			}
+// hasPathPrefix checks if urlPath starts with prefix at a path segment boundary
+func hasPathPrefix(urlPath, prefix string) bool {
+	if !strings.HasPrefix(urlPath, prefix) {
+		return false
+	}
+	return len(urlPath) == len(prefix) || strings.HasSuffix(prefix, "/") || urlPath[len(prefix)] == '/'
+}
+
+// ValidateRequest extracts the bearer token from the request and validates it. Failures are
+// returned as *AuthError, telling the reason.
+func (a *JwtAuthenticator) ValidateRequest(r *http.Request) (*jwt.Token, error) {
+	token, err := a.checkJWT(r)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// checkJWT extracts the bearer token from the request and validates it
+func (a *JwtAuthenticator) checkJWT(r *http.Request) (*jwt.Token, *AuthError) {
+	rawToken, err := jwtmiddleware.FromAuthHeader(r)
+	if err != nil {
+		return nil, &AuthError{Reason: AuthReasonMalformed, Err: err}
+	}
+	if rawToken == "" {
+		return nil, newAuthError(AuthReasonMissingToken, "Required authorization token not found")
+	}
+	if a.cache != nil {
+		if token, found := a.cache.get(rawToken, a.now()); found {
+			return token, nil
 		}
-		return http.HandlerFunc(fn)
 	}
+
+	if a.introspector != nil {
+		return a.introspectToken(r, rawToken)
+	}
+
+	// time based claims are validated separately, to take clock skew into account
+	parser := jwt.Parser{
+		ValidMethods:         []string{jwt.SigningMethodRS256.Alg()},
+		SkipClaimsValidation: true,
+	}
+	token, err := parser.Parse(rawToken, a.getValidationKey)
+	if err != nil {
+		return nil, parseAuthError(err)
+	}
+	if authErr := a.verifyTimeClaims(token.Claims.(jwt.MapClaims)); authErr != nil {
+		return nil, authErr
+	}
+	if authErr := a.runClaimValidators(token.Claims.(jwt.MapClaims)); authErr != nil {
+		return nil, authErr
+	}
+	if a.cache != nil {
+		a.cache.add(token)
+	}
+	return token, nil
+}
+
+// introspectToken validates the opaque token with the introspection endpoint and returns it
+// as a token with the claims of the introspection response
+func (a *JwtAuthenticator) introspectToken(r *http.Request, rawToken string) (*jwt.Token, *AuthError) {
+	claims, authErr := a.introspector.introspect(r.Context(), rawToken)
+	if authErr != nil {
+		return nil, authErr
+	}
+	if authErr := a.verifyClaims(claims); authErr != nil {
+		return nil, authErr
+	}
+	if authErr := a.verifyTimeClaims(claims); authErr != nil {
+		return nil, authErr
+	}
+	if authErr := a.runClaimValidators(claims); authErr != nil {
+		return nil, authErr
+	}
+	token := &jwt.Token{Raw: rawToken, Header: map[string]interface{}{}, Claims: claims, Valid: true}
+	if a.cache != nil {
+		a.cache.add(token)
+	}
+	return token, nil
+}
+
+// parseAuthError converts errors of the JWT parser to AuthError
+func parseAuthError(err error) *AuthError {
+	ve, ok := err.(*jwt.ValidationError)
+	if !ok {
+		return &AuthError{Reason: AuthReasonMalformed, Err: err}
+	}
+	if authErr, ok := ve.Inner.(*AuthError); ok {
+		return authErr
+	}
+	if ve.Errors&jwt.ValidationErrorMalformed != 0 {
+		return &AuthError{Reason: AuthReasonMalformed, Err: err}
+	}
+	return &AuthError{Reason: AuthReasonInvalidSignature, Err: err}
+}
+
+// getValidationKey verifies the token type, audience and issuer and returns the key to validate the token signature
+func (a *JwtAuthenticator) getValidationKey(token *jwt.Token) (interface{}, error) {
+	if err := a.verifyTokenType(token); err != nil {
+		return token, err
+	}
+	if err := a.verifyClaims(token.Claims.(jwt.MapClaims)); err != nil {
+		return token, err
+	}
+	// Load required RSA public key
+	keyID, ok := token.Header["kid"].(string)
+	if !ok {
+		return token, newAuthError(AuthReasonMalformed, "token has no key ID")
+	}
+	return a.getRSAPublicKeyByID(keyID)
 }
 
-// JwksKeyLoader lazily loads and caches JWK certificate, but allows for forced reload
+// verifyClaims verifies the audience and issuer
+func (a *JwtAuthenticator) verifyClaims(claims jwt.MapClaims) *AuthError {
+	// Verify 'aud' claim
+	if !a.skipAudience && !a.verifyAudience(claims) {
+		return newAuthError(AuthReasonInvalidAudience, "invalid audience")
+	}
+	// Verify 'iss' claim
+	if !claims.VerifyIssuer(a.issuer, !a.allowNoIss) {
+		return newAuthError(AuthReasonInvalidIssuer, "invalid issuer")
+	}
+	return nil
+}
+
+// runClaimValidators runs the custom claim validators; the claims must be already verified
+func (a *JwtAuthenticator) runClaimValidators(claims jwt.MapClaims) *AuthError {
+	for _, validate := range a.validators {
+		if err := validate(claims); err != nil {
+			return &AuthError{Reason: AuthReasonInvalidClaim, Err: err}
+		}
+	}
+	return nil
+}
+
+// verifyAudience checks if the 'aud' claim contains any of the accepted audiences
+func (a *JwtAuthenticator) verifyAudience(claims jwt.MapClaims) bool {
+	for _, aud := range a.audiences {
+		if claims.VerifyAudience(aud, !a.allowNoAud) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyTokenType checks the 'typ' header against the allowed token types
+func (a *JwtAuthenticator) verifyTokenType(token *jwt.Token) *AuthError {
+	if a.tokenTypes == nil {
+		return nil
+	}
+	typ, _ := token.Header["typ"].(string)
+	if typ == "" {
+		if a.allowNoType {
+			return nil
+		}
+		return newAuthError(AuthReasonInvalidType, "token has no type")
+	}
+	if !a.tokenTypes[normalizeTokenType(typ)] {
+		return newAuthError(AuthReasonInvalidType, fmt.Sprintf("invalid token type %q", typ))
+	}
+	return nil
+}
+
+// normalizeTokenType makes 'typ' values comparable, as described in RFC 7515, section 4.1.9
+func normalizeTokenType(typ string) string {
+	return strings.TrimPrefix(strings.ToLower(typ), "application/")
+}
+
+// verifyTimeClaims validates 'exp', 'iat' and 'nbf' claims allowing for the configured clock skew
+func (a *JwtAuthenticator) verifyTimeClaims(claims jwt.MapClaims) *AuthError {
+	now := a.now().Unix()
+	skew := int64(a.clockSkew / time.Second)
+	if !claims.VerifyExpiresAt(now-skew, false) {
+		return newAuthError(AuthReasonExpired, "Token is expired")
+	}
+	if !claims.VerifyIssuedAt(now+skew, false) {
+		return newAuthError(AuthReasonNotValidYet, "Token used before issued")
+	}
+	if !claims.VerifyNotBefore(now+skew, false) {
+		return newAuthError(AuthReasonNotValidYet, "Token is not valid yet")
+	}
+	return nil
+}
+
+// JwksKeyLoader lazily loads and caches all the keys published in a JWKS document, indexed
+// by their key ID. It allows for forced reload and periodic background refresh.
 type JwksKeyLoader struct {
-	certLock sync.RWMutex
-	pubKey   *rsa.PublicKey
-	once     *sync.Once
-	jwksURL  string
+	certLock    sync.RWMutex
+	keys        map[string]*rsa.PublicKey
+	pem         bool
+	missingKeys map[string]time.Time
+	stale       bool
+	loadedAt    time.Time
+	minReload   time.Duration
+	failedAt    time.Time
+	loadErr     error
+	backoff     time.Duration
+	loadLock    sync.Mutex
+	jwksURL     string
+	jwksFile    string
+	jwksInline  string
+	userAgent   string
+	headers     map[string]string
+	client      *http.Client
+	refreshLock sync.Mutex
+	refreshStop chan struct{}
+	refreshDone chan struct{}
 }
 
+// JwksKeyLoaderOptions configures JwksKeyLoader
+type JwksKeyLoaderOptions struct {
+	// JwksURL is the URL of the JWKS document
+	JwksURL string
+	// JwksFile is the path of a local JWKS document or PEM encoded public keys or certificates,
+	// used instead of JwksURL, e.g. in air-gapped environments; Reload() re-reads the file
+	JwksFile string
+	// JwksInline is a JWKS document or PEM encoded public keys or certificates, used instead of
+	// JwksURL and JwksFile
+	JwksInline string
+	// UserAgent sent when fetching the JWKS document; defaults to DefaultJwksUserAgent()
+	UserAgent string
+	// RequestHeaders are additional headers sent when fetching the JWKS document, e.g. to
+	// identify the client to the JWKS endpoint operators
+	RequestHeaders map[string]string
+	// HTTPClient is used to fetch the JWKS document; defaults to a client with
+	// DefaultJwksTimeout, so a hung endpoint can't block authentication forever
+	HTTPClient *http.Client
+	// MinReloadInterval is the minimum time between the last load of the keys and a reload
+	// triggered by an unknown key ID; unknown key IDs seen sooner are rejected without fetching
+	// the JWKS document, so clients cycling key IDs can't make the server fetch it on every
+	// request. Defaults to DefaultJwksMinReloadInterval; a negative value disables the limit.
+	MinReloadInterval time.Duration
+	// FailureBackoff is the time after a failed load, during which keys that aren't cached
+	// fail immediately with the load error instead of fetching the JWKS document again, so
+	// requests don't pile up waiting for an unavailable endpoint. Defaults to
+	// DefaultJwksFailureBackoff; a negative value disables the backoff.
+	FailureBackoff time.Duration
+}
+
+const (
+	// DefaultJwksTimeout is the timeout of the default HTTP client fetching JWKS documents
+	DefaultJwksTimeout = 10 * time.Second
+	// DefaultJwksMinReloadInterval is the default of JwksKeyLoaderOptions.MinReloadInterval
+	DefaultJwksMinReloadInterval = 30 * time.Second
+	// DefaultJwksFailureBackoff is the default of JwksKeyLoaderOptions.FailureBackoff
+	DefaultJwksFailureBackoff = 5 * time.Second
+	// missingKeyTTL is how long a key ID missing after a reload doesn't trigger reloads
+	missingKeyTTL = 5 * time.Minute
+	// maxMissingKeys limits the number of remembered missing key IDs
+	maxMissingKeys = 1024
+	// maxJwksSize limits the size of downloaded JWKS documents
+	maxJwksSize = 1 << 20
+)
+
 // NewJwksKeyLoader returns new JwkCertLoader
 func NewJwksKeyLoader(jwksURL string) *JwksKeyLoader {
+	return NewJwksKeyLoaderWithOptions(JwksKeyLoaderOptions{JwksURL: jwksURL})
+}
+
+// NewJwksKeyLoaderWithOptions returns new JwksKeyLoader configured with JwksKeyLoaderOptions
+func NewJwksKeyLoaderWithOptions(options JwksKeyLoaderOptions) *JwksKeyLoader {
+	userAgent := options.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultJwksUserAgent()
+	}
+	client := options.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: DefaultJwksTimeout}
+	}
+	minReload := options.MinReloadInterval
+	if minReload == 0 {
+		minReload = DefaultJwksMinReloadInterval
+	}
+	backoff := options.FailureBackoff
+	if backoff == 0 {
+		backoff = DefaultJwksFailureBackoff
+	}
 	return &JwksKeyLoader{
-		jwksURL: jwksURL,
-		once:    &sync.Once{},
+		missingKeys: map[string]time.Time{},
+		minReload:   minReload,
+		backoff:     backoff,
+		jwksURL:     options.JwksURL,
+		jwksFile:    options.JwksFile,
+		jwksInline:  options.JwksInline,
+		userAgent:   userAgent,
+		headers:     options.RequestHeaders,
+		client:      client,
 	}
 }
 
-// GetPublicKey loads the cert from the online JWKS if not yet loaded
-// otherwise returns cached version
+// DefaultJwksUserAgent returns the User-Agent used to fetch JWKS documents, including the
+// version of this module if it's known
+func DefaultJwksUserAgent() string {
+	version := "devel"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Path == modulePath && info.Main.Version != "" {
+			version = info.Main.Version
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath && dep.Version != "" {
+				version = dep.Version
+			}
+		}
+	}
+	return fmt.Sprintf("go-chi-middleware-server/%s (+https://%s)", version, modulePath)
+}
+
+// GetPublicKey loads the keys from the JWKS if not yet loaded, otherwise returns cached
+// version. A failed load isn't cached, but for FailureBackoff after it, keys that aren't
+// cached fail immediately with the same error; the first call after that tries again. If the requested key
+// ID is not known, the keys are reloaded once, but not sooner than MinReloadInterval after
+// the last load; a key ID still missing after that reload doesn't trigger any more reloads
+// for a few minutes, unless the keys are reloaded for other reasons and it shows up.
 func (l *JwksKeyLoader) GetPublicKey(keyID string) (*rsa.PublicKey, error) {
-	var doErr error
-	l.once.Do(func() {
-		var pubKey *rsa.PublicKey
-		resp, err := http.Get(l.jwksURL)
+	if key, found, missing := l.lookup(keyID); found {
+		return key, nil
+	} else if missing || l.reloadedRecently() {
+		return nil, errKeyNotFound
+	}
+	if err := l.recentLoadError(); err != nil {
+		return nil, err
+	}
+
+	// keys are not loaded yet, the last load failed, a reload was requested or the key ID is
+	// unknown, possibly because of key rotation: load the keys, but only once for all the
+	// concurrent requests asking for it
+	l.loadLock.Lock()
+	defer l.loadLock.Unlock()
+	if key, found, missing := l.lookup(keyID); found {
+		return key, nil
+	} else if missing || l.reloadedRecently() {
+		return nil, errKeyNotFound
+	}
+	if err := l.recentLoadError(); err != nil {
+		return nil, err
+	}
+	if err := l.loadLocked(); err != nil {
+		return nil, err
+	}
+	if key, found, _ := l.lookup(keyID); found {
+		return key, nil
+	}
+	l.addMissingKey(keyID)
+	return nil, errKeyNotFound
+}
+
+// reloadedRecently checks if the keys were loaded less than MinReloadInterval ago; a reload
+// requested with Reload() isn't limited
+func (l *JwksKeyLoader) reloadedRecently() bool {
+	l.certLock.RLock()
+	defer l.certLock.RUnlock()
+	return l.keys != nil && !l.stale && time.Since(l.loadedAt) < l.minReload
+}
+
+// recentLoadError returns the error of the last load if it failed less than FailureBackoff ago
+func (l *JwksKeyLoader) recentLoadError() error {
+	l.certLock.RLock()
+	defer l.certLock.RUnlock()
+	if l.loadErr != nil && time.Since(l.failedAt) < l.backoff {
+		return l.loadErr
+	}
+	return nil
+}
+
+// addMissingKey remembers the key ID as missing after a reload. Expired entries are dropped
+// when the limit of remembered key IDs is reached; if it's still reached, the key ID isn't
+// remembered, as MinReloadInterval limits the reloads anyway.
+func (l *JwksKeyLoader) addMissingKey(keyID string) {
+	l.certLock.Lock()
+	defer l.certLock.Unlock()
+	now := time.Now()
+	if len(l.missingKeys) >= maxMissingKeys {
+		for id, missingSince := range l.missingKeys {
+			if now.Sub(missingSince) >= missingKeyTTL {
+				delete(l.missingKeys, id)
+			}
+		}
+	}
+	if len(l.missingKeys) < maxMissingKeys {
+		l.missingKeys[keyID] = now
+	}
+}
+
+// lookup returns the cached key with the given ID and whether it was found or is already
+// known to be missing after a reload. A key loaded from PEM has no ID and matches any ID;
+// JWKS keys without an ID match only tokens without one.
+// Nothing is found when Reload() was requested.
+func (l *JwksKeyLoader) lookup(keyID string) (key *rsa.PublicKey, found bool, missing bool) {
+	l.certLock.RLock()
+	defer l.certLock.RUnlock()
+	if l.stale {
+		return nil, false, false
+	}
+	key, found = l.keys[keyID]
+	if !found && l.pem {
+		key, found = l.keys[pemKeyID]
+	}
+	if missingSince, known := l.missingKeys[keyID]; known {
+		missing = time.Since(missingSince) < missingKeyTTL
+	}
+	return key, found, missing
+}
 
+// load fetches the JWKS document and replaces all the cached keys
+func (l *JwksKeyLoader) load() error {
+	l.loadLock.Lock()
+	defer l.loadLock.Unlock()
+	return l.loadLocked()
+}
+
+func (l *JwksKeyLoader) loadLocked() error {
+	keys, pem, err := l.fetchPublicKeys()
+	l.certLock.Lock()
+	defer l.certLock.Unlock()
+	if err != nil {
+		l.loadErr = err
+		l.failedAt = time.Now()
+		return err
+	}
+
+	l.keys = keys
+	l.pem = pem
+	l.loadErr = nil
+	// the negative entries are kept, only the key IDs published now are forgotten
+	for keyID := range keys {
+		delete(l.missingKeys, keyID)
+	}
+	l.stale = false
+	l.loadedAt = time.Now()
+	return nil
+}
+
+// isJSONContentType checks if the media type is JSON, like "application/json" or
+// "application/jwk-set+json". Missing content type is accepted.
+func isJSONContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// fetchPublicKeys reads the JWKS document from the configured source and returns all the
+// RSA public keys it contains, and whether it was a PEM encoded key
+func (l *JwksKeyLoader) fetchPublicKeys() (map[string]*rsa.PublicKey, bool, error) {
+	switch {
+	case l.jwksInline != "":
+		return l.parsePublicKeys([]byte(l.jwksInline))
+	case l.jwksFile != "":
+		data, err := ioutil.ReadFile(l.jwksFile)
 		if err != nil {
-			doErr = err
-			return
+			return nil, false, fmt.Errorf("can't read JWKS file: %v", err)
 		}
-		defer resp.Body.Close()
+		return l.parsePublicKeys(data)
+	}
+	return l.downloadPublicKeys()
+}
+
+// downloadPublicKeys downloads the JWKS document from JwksURL and returns its RSA public keys
+func (l *JwksKeyLoader) downloadPublicKeys() (map[string]*rsa.PublicKey, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, l.jwksURL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	for name, value := range l.headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("User-Agent", l.userAgent)
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, false, fmt.Errorf("JWKS endpoint %s returned unexpected status %s", l.jwksURL, resp.Status)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !isJSONContentType(contentType) {
+		return nil, false, fmt.Errorf("JWKS endpoint %s returned unexpected content type %q, expected JSON", l.jwksURL, contentType)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxJwksSize+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(data) > maxJwksSize {
+		return nil, false, fmt.Errorf("JWKS endpoint %s returned a document larger than %d bytes", l.jwksURL, maxJwksSize)
+	}
+	return l.parsePublicKeys(data)
+}
 
-		var keys = jwks{}
-		err = json.NewDecoder(resp.Body).Decode(&keys)
+// errKeyNotFound is returned when the JWKS has no key with the requested ID
+var errKeyNotFound = errors.New("unable to find appropriate key")
 
+// pemKeyID is the ID of keys loaded from PEM, which can't carry one
+const pemKeyID = ""
+
+// parsePublicKeys returns the RSA public keys from a JWKS document or PEM encoded keys or
+// certificates, and whether it was PEM
+func (l *JwksKeyLoader) parsePublicKeys(data []byte) (map[string]*rsa.PublicKey, bool, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		keys, err := parsePEMPublicKeys(data)
+		return keys, err == nil, err
+	}
+	var keys = jwks{}
+	err := json.Unmarshal(data, &keys)
+	if err != nil {
+		return nil, false, err
+	}
+
+	pubKeys := make(map[string]*rsa.PublicKey, len(keys.Keys))
+	for _, key := range keys.Keys {
+		if key.Kty != "RSA" {
+			continue
+		}
+		var pubKey *rsa.PublicKey
+		if len(key.X5c) > 0 {
+			newCert := "-----BEGIN CERTIFICATE-----\n" + key.X5c[0] + "\n-----END CERTIFICATE-----"
+			pubKey, err = jwt.ParseRSAPublicKeyFromPEM([]byte(newCert))
+		} else {
+			pubKey, err = l.loadKeysFromComponents(key)
+		}
 		if err != nil {
-			doErr = err
-			return
+			continue
 		}
+		pubKeys[key.Kid] = pubKey
+	}
 
-		for k := range keys.Keys {
-			if keyID == keys.Keys[k].Kid {
-				if len(keys.Keys[k].X5c) > 0 {
-					newCert := "-----BEGIN CERTIFICATE-----\n" + keys.Keys[k].X5c[0] + "\n-----END CERTIFICATE-----"
-					pubKey, err = jwt.ParseRSAPublicKeyFromPEM([]byte(newCert))
-				} else {
-					pubKey, err = l.loadKeysFromComponents(keys.Keys[k])
+	if len(pubKeys) == 0 {
+		return nil, false, errors.New("unable to find any usable key in JWKS")
+	}
+	return pubKeys, false, nil
+}
+
+// parsePEMPublicKeys returns the RSA public key from PEM encoded public keys or certificates.
+// As PEM keys have no ID, only a single key is supported.
+func parsePEMPublicKeys(data []byte) (map[string]*rsa.PublicKey, error) {
+	pubKey, err := jwt.ParseRSAPublicKeyFromPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse PEM public key: %v", err)
+	}
+	return map[string]*rsa.PublicKey{pemKeyID: pubKey}, nil
+}
+
+// StartRefresh starts a goroutine, which re-fetches the JWKS document every interval and
+// swaps the cached keys. If the refresh fails, the previously cached keys are kept and the
+// error is logged. Calling StartRefresh when the refresh is already running is a no-op.
+func (l *JwksKeyLoader) StartRefresh(interval time.Duration, logger logrus.FieldLogger) {
+	l.refreshLock.Lock()
+	defer l.refreshLock.Unlock()
+	if l.refreshStop != nil || interval <= 0 {
+		return
+	}
+	l.refreshStop = make(chan struct{})
+	l.refreshDone = make(chan struct{})
+
+	go func(stop <-chan struct{}, done chan<- struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := l.load(); err != nil {
+					logger.Errorf("Error refreshing JWKS keys from %s, keeping the cached ones: %v", l.jwksURL, err)
 				}
 			}
 		}
+	}(l.refreshStop, l.refreshDone)
+}
 
-		if pubKey == nil {
-			doErr = errors.New("unable to find appropriate key")
-			return
-		}
-
-		l.certLock.Lock()
-		l.pubKey = pubKey
-		l.certLock.Unlock()
+// StopRefresh stops the background refresh goroutine and waits for it to exit
+func (l *JwksKeyLoader) StopRefresh() {
+	l.refreshLock.Lock()
+	defer l.refreshLock.Unlock()
+	if l.refreshStop == nil {
 		return
-	})
-	if doErr != nil {
-		return nil, doErr
 	}
-	l.certLock.RLock()
-	defer l.certLock.RUnlock()
-	return l.pubKey, nil
+	close(l.refreshStop)
+	<-l.refreshDone
+	l.refreshStop = nil
+	l.refreshDone = nil
 }
 
 // adapted from https://stackoverflow.com/questions/25179492/create-public-key-from-modulus-and-exponent-in-golang
@@ -219,7 +982,9 @@ func (l *JwksKeyLoader) loadKeysFromComponents(key jsonWebKey) (*rsa.PublicKey,
 	return pKey, nil
 }
 
-// Reload force the certificate to be reloaded from the source on the next GetCert() call
+// Reload force the keys to be reloaded from the source on the next GetPublicKey() call
 func (l *JwksKeyLoader) Reload() {
-	l.once = &sync.Once{}
+	l.certLock.Lock()
+	defer l.certLock.Unlock()
+	l.stale = true
 }
@@ -0,0 +1,951 @@
+package middleware_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/golang-jwt/jwt"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/piontec/go-chi-middleware-server/pkg/server/middleware"
+)
+
+// jwksTestServer serves a JWKS document built from the configured keys and counts fetches
+type jwksTestServer struct {
+	*httptest.Server
+	lock    sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	status  int
+	fetches int32
+	headers http.Header
+}
+
+func newJwksTestServer(keys map[string]*rsa.PublicKey) *jwksTestServer {
+	s := &jwksTestServer{keys: keys, status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.fetches, 1)
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.headers = r.Header
+		if s.status != http.StatusOK {
+			w.WriteHeader(s.status)
+			w.Write([]byte("<html>error</html>"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jwksDocument(s.keys))
+	}))
+	return s
+}
+
+func (s *jwksTestServer) setKeys(keys map[string]*rsa.PublicKey) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keys = keys
+}
+
+func (s *jwksTestServer) setStatus(status int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status = status
+}
+
+func (s *jwksTestServer) lastHeaders() http.Header {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.headers
+}
+
+func (s *jwksTestServer) fetchCount() int {
+	return int(atomic.LoadInt32(&s.fetches))
+}
+
+func jwksDocument(keys map[string]*rsa.PublicKey) map[string]interface{} {
+	jwkList := []map[string]string{}
+	for kid, key := range keys {
+		jwkList = append(jwkList, map[string]string{
+			"kty": "RSA",
+			"kid": kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	return map[string]interface{}{"keys": jwkList}
+}
+
+func newTestKey(t testing.TB) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Can't generate RSA key: %v", err)
+	}
+	return key
+}
+
+const (
+	testAudience = "http://localhost"
+	testIssuer   = "https://your-oidc-provider.com/"
+)
+
+func signTestToken(t testing.TB, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("Can't sign JWT token: %v", err)
+	}
+	return signed
+}
+
+func testClaims(expiresIn time.Duration) jwt.MapClaims {
+	return jwt.MapClaims{
+		"aud": testAudience,
+		"iss": testIssuer,
+		"sub": "test-user",
+		"exp": time.Now().Add(expiresIn).Unix(),
+	}
+}
+
+// serveAuthenticated runs a request with the given bearer token through the authenticator
+func serveAuthenticated(auth *middleware.JwtAuthenticator, method, path, token string) *httptest.ResponseRecorder {
+	handler := auth.GetHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestJwksKeyLoaderBackgroundRefresh(t *testing.T) {
+	oldKey, newKey := newTestKey(t), newTestKey(t)
+	jwksServer := newJwksTestServer(map[string]*rsa.PublicKey{"k1": &oldKey.PublicKey})
+	defer jwksServer.Close()
+	logger, hook := test.NewNullLogger()
+
+	loader := middleware.NewJwksKeyLoader(jwksServer.URL)
+	key, err := loader.GetPublicKey("k1")
+	assert.Nil(t, err)
+	assert.Equal(t, oldKey.PublicKey.N, key.N)
+
+	loader.StartRefresh(20*time.Millisecond, logger)
+	defer loader.StopRefresh()
+
+	// a failing refresh keeps serving the cached key and logs the failure
+	jwksServer.setStatus(http.StatusInternalServerError)
+	time.Sleep(100 * time.Millisecond)
+	key, err = loader.GetPublicKey("k1")
+	assert.Nil(t, err)
+	assert.Equal(t, oldKey.PublicKey.N, key.N)
+	if assert.NotNil(t, hook.LastEntry()) {
+		assert.Equal(t, logrus.ErrorLevel, hook.LastEntry().Level)
+	}
+
+	// a successful refresh swaps the cached key
+	jwksServer.setKeys(map[string]*rsa.PublicKey{"k1": &newKey.PublicKey})
+	jwksServer.setStatus(http.StatusOK)
+	time.Sleep(100 * time.Millisecond)
+	key, err = loader.GetPublicKey("k1")
+	assert.Nil(t, err)
+	assert.Equal(t, newKey.PublicKey.N, key.N)
+
+	// no fetches happen after the refresh is stopped
+	loader.StopRefresh()
+	fetches := jwksServer.fetchCount()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, fetches, jwksServer.fetchCount())
+}
+
+func TestJwksKeyLoaderCachesAllKeysByID(t *testing.T) {
+	key1, key2 := newTestKey(t), newTestKey(t)
+	jwksServer := newJwksTestServer(map[string]*rsa.PublicKey{
+		"k1": &key1.PublicKey,
+		"k2": &key2.PublicKey,
+	})
+	defer jwksServer.Close()
+
+	loader := middleware.NewJwksKeyLoader(jwksServer.URL)
+	for i := 0; i < 3; i++ {
+		key, err := loader.GetPublicKey("k1")
+		assert.Nil(t, err)
+		assert.Equal(t, key1.PublicKey.N, key.N)
+		key, err = loader.GetPublicKey("k2")
+		assert.Nil(t, err)
+		assert.Equal(t, key2.PublicKey.N, key.N)
+	}
+	assert.Equal(t, 1, jwksServer.fetchCount())
+}
+
+func TestJwksKeyLoaderReloadsOnceForMissingKey(t *testing.T) {
+	key1, key3 := newTestKey(t), newTestKey(t)
+	jwksServer := newJwksTestServer(map[string]*rsa.PublicKey{"k1": &key1.PublicKey})
+	defer jwksServer.Close()
+
+	loader := middleware.NewJwksKeyLoaderWithOptions(middleware.JwksKeyLoaderOptions{
+		JwksURL:           jwksServer.URL,
+		MinReloadInterval: -1,
+	})
+	_, err := loader.GetPublicKey("k1")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, jwksServer.fetchCount())
+
+	// concurrent requests for an unknown key trigger exactly one reload
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := loader.GetPublicKey("k3")
+			assert.NotNil(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 2, jwksServer.fetchCount())
+
+	// the key is known to be missing, so no more reloads happen
+	_, err = loader.GetPublicKey("k3")
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, jwksServer.fetchCount())
+
+	// reloads for other key IDs don't forget the missing ones
+	_, err = loader.GetPublicKey("k4")
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, jwksServer.fetchCount())
+	_, err = loader.GetPublicKey("k3")
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, jwksServer.fetchCount())
+
+	// after a key rotation and forced reload, the new key is available
+	jwksServer.setKeys(map[string]*rsa.PublicKey{"k1": &key1.PublicKey, "k3": &key3.PublicKey})
+	loader.Reload()
+	key, err := loader.GetPublicKey("k3")
+	assert.Nil(t, err)
+	assert.Equal(t, key3.PublicKey.N, key.N)
+	assert.Equal(t, 4, jwksServer.fetchCount())
+}
+
+func TestJwksKeyLoaderLimitsReloads(t *testing.T) {
+	key1, key2 := newTestKey(t), newTestKey(t)
+	jwksServer := newJwksTestServer(map[string]*rsa.PublicKey{"k1": &key1.PublicKey})
+	defer jwksServer.Close()
+
+	loader := middleware.NewJwksKeyLoader(jwksServer.URL)
+	_, err := loader.GetPublicKey("k1")
+	assert.Nil(t, err)
+
+	// unknown key IDs right after a load are rejected without fetching the JWKS document
+	for i := 0; i < 10; i++ {
+		_, err := loader.GetPublicKey(fmt.Sprintf("attacker-%d", i))
+		assert.NotNil(t, err)
+	}
+	assert.Equal(t, 1, jwksServer.fetchCount())
+
+	// a forced reload isn't limited
+	jwksServer.setKeys(map[string]*rsa.PublicKey{"k1": &key1.PublicKey, "k2": &key2.PublicKey})
+	loader.Reload()
+	key, err := loader.GetPublicKey("k2")
+	assert.Nil(t, err)
+	assert.Equal(t, key2.PublicKey.N, key.N)
+	assert.Equal(t, 2, jwksServer.fetchCount())
+}
+
+func TestJWTAuthenticatorClockSkew(t *testing.T) {
+	key := newTestKey(t)
+	jwksServer := newJwksTestServer(map[string]*rsa.PublicKey{"k1": &key.PublicKey})
+	defer jwksServer.Close()
+	expiredToken := signTestToken(t, key, "k1", testClaims(-10*time.Second))
+
+	strict := middleware.NewJWTAuthenticatorWithOptions(middleware.JWTAuthenticatorOptions{
+		Audience: testAudience,
+		Issuer:   testIssuer,
+		JwksURL:  jwksServer.URL,
+	})
+	assert.Equal(t, http.StatusUnauthorized, serveAuthenticated(strict, "GET", "/hello", expiredToken).Code)
+
+	lenient := middleware.NewJWTAuthenticatorWithOptions(middleware.JWTAuthenticatorOptions{
+		Audience:  testAudience,
+		Issuer:    testIssuer,
+		JwksURL:   jwksServer.URL,
+		ClockSkew: 30 * time.Second,
+	})
+	assert.Equal(t, http.StatusOK, serveAuthenticated(lenient, "GET", "/hello", expiredToken).Code)
+
+	// tokens expired for longer than the skew are still rejected
+	oldToken := signTestToken(t, key, "k1", testClaims(-time.Minute))
+	assert.Equal(t, http.StatusUnauthorized, serveAuthenticated(lenient, "GET", "/hello", oldToken).Code)
+}
+
+func TestJWTAuthenticatorTokenCache(t *testing.T) {
+	key, otherKey := newTestKey(t), newTestKey(t)
+	jwksServer := newJwksTestServer(map[string]*rsa.PublicKey{"k1": &key.PublicKey})
+	defer jwksServer.Close()
+	var offset int64
+	auth := middleware.NewJWTAuthenticatorWithOptions(middleware.JWTAuthenticatorOptions{
+		Audience:       testAudience,
+		Issuer:         testIssuer,
+		JwksURL:        jwksServer.URL,
+		TokenCacheSize: 10,
+		Clock: func() time.Time {
+			return time.Now().Add(time.Duration(atomic.LoadInt64(&offset)))
+		},
+	})
+	cachedToken := signTestToken(t, key, "k1", testClaims(time.Hour))
+	assert.Equal(t, http.StatusOK, serveAuthenticated(auth, "GET", "/hello", cachedToken).Code)
+
+	// after the signing key is replaced, only the cached token skips signature verification
+	jwksServer.setKeys(map[string]*rsa.PublicKey{"k1": &otherKey.PublicKey})
+	auth.ReloadKeys()
+	freshToken := signTestToken(t, key, "k1", testClaims(time.Hour+time.Minute))
+	assert.Equal(t, http.StatusUnauthorized, serveAuthenticated(auth, "GET", "/hello", freshToken).Code)
+	assert.Equal(t, http.StatusOK, serveAuthenticated(auth, "GET", "/hello", cachedToken).Code)
+
+	// once the token expires, it's dropped from the cache and re-validated
+	atomic.StoreInt64(&offset, int64(2*time.Hour))
+	assert.Equal(t, http.StatusUnauthorized, serveAuthenticated(auth, "GET", "/hello", cachedToken).Code)
+}
+
+func BenchmarkJWTAuthenticator(b *testing.B) {
+	key := newTestKey(b)
+	jwksServer := newJwksTestServer(map[string]*rsa.PublicKey{"k1": &key.PublicKey})
+	defer jwksServer.Close()
+	token := signTestToken(b, key, "k1", testClaims(time.Hour))
+
+	for _, cacheSize := range []int{0, 100} {
+		auth := middleware.NewJWTAuthenticatorWithOptions(middleware.JWTAuthenticatorOptions{
+			Audience:       testAudience,
+			Issuer:         testIssuer,
+			JwksURL:        jwksServer.URL,
+			TokenCacheSize: cacheSize,
+		})
+		b.Run(fmt.Sprintf("cache-size-%d", cacheSize), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if code := serveAuthenticated(auth, "GET", "/hello", token).Code; code != http.StatusOK {
+					b.Fatalf("Unexpected response code: %d", code)
+				}
+			}
+		})
+	}
+}
+
+func TestJwksKeyLoaderUserAgent(t *testing.T) {
+	key := newTestKey(t)
+	jwksServer := newJwksTestServer(map[string]*rsa.PublicKey{"k1": &key.PublicKey})
+	defer jwksServer.Close()
+
+	loader := middleware.NewJwksKeyLoader(jwksServer.URL)
+	_, err := loader.GetPublicKey("k1")
+	assert.Nil(t, err)
+	assert.Equal(t, middleware.DefaultJwksUserAgent(), jwksServer.lastHeaders().Get("User-Agent"))
+	assert.Contains(t, jwksServer.lastHeaders().Get("User-Agent"), "go-chi-middleware-server/")
+
+	loader = middleware.NewJwksKeyLoaderWithOptions(middleware.JwksKeyLoaderOptions{
+		JwksURL:        jwksServer.URL,
+		UserAgent:      "my-api/1.0",
+		RequestHeaders: map[string]string{"X-Client-Id": "my-api"},
+	})
+	_, err = loader.GetPublicKey("k1")
+	assert.Nil(t, err)
+	assert.Equal(t, "my-api/1.0", jwksServer.lastHeaders().Get("User-Agent"))
+	assert.Equal(t, "my-api", jwksServer.lastHeaders().Get("X-Client-Id"))
+}
+
+func TestTokenFingerprint(t *testing.T) {
+	key := newTestKey(t)
+	jwksServer := newJwksTestServer(map[string]*rsa.PublicKey{"k1": &key.PublicKey})
+	defer jwksServer.Close()
+	auth := middleware.NewJWTAuthenticator(testAudience, testIssuer, jwksServer.URL, nil)
+
+	fingerprint := func(token string) string {
+		result := ""
+		handler := auth.GetHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			result = middleware.TokenFingerprint(r)
+		}))
+		req := httptest.NewRequest("GET", "/hello", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		return result
+	}
+
+	token := signTestToken(t, key, "k1", testClaims(time.Hour))
+	otherClaims := testClaims(time.Hour)
+	otherClaims["sub"] = "other-user"
+	otherToken := signTestToken(t, key, "k1", otherClaims)
+
+	first := fingerprint(token)
+	assert.Len(t, first, 16)
+	assert.Equal(t, first, fingerprint(token))
+	assert.NotEqual(t, first, fingerprint(otherToken))
+	assert.Equal(t, "", middleware.TokenFingerprint(httptest.NewRequest("GET", "/hello", nil)))
+}
+
+func TestJwksKeyLoaderRejectsInvalidResponses(t *testing.T) {
+	key := newTestKey(t)
+	cases := map[string]struct {
+		status      int
+		contentType string
+		body        string
+		err         string
+	}{
+		"html error page": {http.StatusOK, "text/html; charset=utf-8", "<html>{\"keys\": []}</html>", "unexpected content type \"text/html; charset=utf-8\""},
+		"non-2xx status":  {http.StatusBadGateway, "application/json", "{}", "unexpected status 502 Bad Gateway"},
+		"unavailable":     {http.StatusServiceUnavailable, "text/html", "<html>maintenance</html>", "unexpected status 503 Service Unavailable"},
+		"oversized":       {http.StatusOK, "application/json", `{"keys": [` + strings.Repeat(" ", 1<<20) + `]}`, "document larger than 1048576 bytes"},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", c.contentType)
+				w.WriteHeader(c.status)
+				w.Write([]byte(c.body))
+			}))
+			defer srv.Close()
+
+			_, err := middleware.NewJwksKeyLoader(srv.URL).GetPublicKey("k1")
+			if assert.NotNil(t, err) {
+				assert.Contains(t, err.Error(), c.err)
+			}
+		})
+	}
+
+	// JWK set specific media type is accepted
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/jwk-set+json")
+		json.NewEncoder(w).Encode(jwksDocument(map[string]*rsa.PublicKey{"k1": &key.PublicKey}))
+	}))
+	defer srv.Close()
+	_, err := middleware.NewJwksKeyLoader(srv.URL).GetPublicKey("k1")
+	assert.Nil(t, err)
+}
+
+func TestJWTAuthenticatorTokenType(t *testing.T) {
+	key := newTestKey(t)
+	jwksServer := newJwksTestServer(map[string]*rsa.PublicKey{"k1": &key.PublicKey})
+	defer jwksServer.Close()
+	signWithType := func(typ string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, testClaims(time.Hour))
+		token.Header["kid"] = "k1"
+		if typ == "" {
+			delete(token.Header, "typ")
+		} else {
+			token.Header["typ"] = typ
+		}
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("Can't sign JWT token: %v", err)
+		}
+		return signed
+	}
+	options := middleware.JWTAuthenticatorOptions{
+		Audience:          testAudience,
+		Issuer:            testIssuer,
+		JwksURL:           jwksServer.URL,
+		AllowedTokenTypes: []string{"at+jwt"},
+	}
+
+	strict := middleware.NewJWTAuthenticatorWithOptions(options)
+	assert.Equal(t, http.StatusOK, serveAuthenticated(strict, "GET", "/hello", signWithType("at+jwt")).Code)
+	assert.Equal(t, http.StatusOK, serveAuthenticated(strict, "GET", "/hello", signWithType("application/AT+JWT")).Code)
+	rec := serveAuthenticated(strict, "GET", "/hello", signWithType("JWT"))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), "invalid token type")
+	assert.Equal(t, http.StatusUnauthorized, serveAuthenticated(strict, "GET", "/hello", signWithType("")).Code)
+
+	options.AllowMissingTokenType = true
+	lenient := middleware.NewJWTAuthenticatorWithOptions(options)
+	assert.Equal(t, http.StatusOK, serveAuthenticated(lenient, "GET", "/hello", signWithType("")).Code)
+	assert.Equal(t, http.StatusUnauthorized, serveAuthenticated(lenient, "GET", "/hello", signWithType("JWT")).Code)
+}
+
+func TestJWTAuthenticatorAudiences(t *testing.T) {
+	key := newTestKey(t)
+	jwksServer := newJwksTestServer(map[string]*rsa.PublicKey{"k1": &key.PublicKey})
+	defer jwksServer.Close()
+	withAudience := func(aud interface{}) string {
+		claims := testClaims(time.Hour)
+		claims["aud"] = aud
+		return signTestToken(t, key, "k1", claims)
+	}
+
+	single := middleware.NewJWTAuthenticator(testAudience, testIssuer, jwksServer.URL, nil)
+	assert.Equal(t, http.StatusOK, serveAuthenticated(single, "GET", "/", withAudience([]string{"other", testAudience})).Code)
+	assert.Equal(t, http.StatusUnauthorized, serveAuthenticated(single, "GET", "/", withAudience([]string{"other", "another"})).Code)
+
+	multi := middleware.NewJWTAuthenticatorWithOptions(middleware.JWTAuthenticatorOptions{
+		Audience:  testAudience,
+		Audiences: []string{"https://api.example.com", "https://admin.example.com"},
+		Issuer:    testIssuer,
+		JwksURL:   jwksServer.URL,
+	})
+	for _, aud := range []interface{}{testAudience, "https://admin.example.com", []string{"other", "https://api.example.com"}} {
+		assert.Equal(t, http.StatusOK, serveAuthenticated(multi, "GET", "/", withAudience(aud)).Code, aud)
+	}
+	for _, aud := range []interface{}{"other", []string{"other", "another"}} {
+		assert.Equal(t, http.StatusUnauthorized, serveAuthenticated(multi, "GET", "/", withAudience(aud)).Code, aud)
+	}
+
+	listOnly := middleware.NewJWTAuthenticatorWithOptions(middleware.JWTAuthenticatorOptions{
+		Audiences: []string{"https://api.example.com"},
+		Issuer:    testIssuer,
+		JwksURL:   jwksServer.URL,
+	})
+	assert.Equal(t, http.StatusOK, serveAuthenticated(listOnly, "GET", "/", withAudience("https://api.example.com")).Code)
+	assert.Equal(t, http.StatusUnauthorized, serveAuthenticated(listOnly, "GET", "/", withAudience(testAudience)).Code)
+}
+
+func TestJWTAuthenticatorClaimValidators(t *testing.T) {
+	key := newTestKey(t)
+	jwksServer := newJwksTestServer(map[string]*rsa.PublicKey{"k1": &key.PublicKey})
+	defer jwksServer.Close()
+	tenants := map[string]bool{"acme": true}
+	var validated int32
+	auth := middleware.NewJWTAuthenticatorWithOptions(middleware.JWTAuthenticatorOptions{
+		Audience: testAudience,
+		Issuer:   testIssuer,
+		JwksURL:  jwksServer.URL,
+		ClaimValidators: []func(jwt.MapClaims) error{
+			func(claims jwt.MapClaims) error {
+				atomic.AddInt32(&validated, 1)
+				if tenant, _ := claims["tenant_id"].(string); !tenants[tenant] {
+					return errors.New("tenant is not allowed")
+				}
+				return nil
+			},
+			func(claims jwt.MapClaims) error {
+				if verified, _ := claims["email_verified"].(bool); !verified {
+					return errors.New("email is not verified")
+				}
+				return nil
+			},
+		},
+	})
+	token := func(tenant string, verified bool) string {
+		claims := testClaims(time.Hour)
+		claims["tenant_id"] = tenant
+		claims["email_verified"] = verified
+		return signTestToken(t, key, "k1", claims)
+	}
+
+	assert.Equal(t, http.StatusOK, serveAuthenticated(auth, "GET", "/", token("acme", true)).Code)
+	rec := serveAuthenticated(auth, "GET", "/", token("other", true))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), "tenant is not allowed")
+	rec = serveAuthenticated(auth, "GET", "/", token("acme", false))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), "email is not verified")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token("other", true))
+	_, err := auth.ValidateRequest(req)
+	authErr, ok := err.(*middleware.AuthError)
+	if assert.True(t, ok) {
+		assert.Equal(t, middleware.AuthReasonInvalidClaim, authErr.Reason)
+	}
+
+	// validators only see claims of tokens with a valid signature, which aren't expired
+	atomic.StoreInt32(&validated, 0)
+	claims := testClaims(time.Hour)
+	claims["tenant_id"] = "acme"
+	claims["email_verified"] = true
+	assert.Equal(t, http.StatusUnauthorized, serveAuthenticated(auth, "GET", "/", signTestToken(t, newTestKey(t), "k1", claims)).Code)
+	assert.Equal(t, http.StatusUnauthorized, serveAuthenticated(auth, "GET", "/", signTestToken(t, key, "k1", testClaims(-time.Hour))).Code)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&validated))
+}
+
+func TestJWTAuthenticatorMissingAudienceAndIssuer(t *testing.T) {
+	key := newTestKey(t)
+	jwksServer := newJwksTestServer(map[string]*rsa.PublicKey{"k1": &key.PublicKey})
+	defer jwksServer.Close()
+	without := func(claim string) string {
+		claims := testClaims(time.Hour)
+		delete(claims, claim)
+		return signTestToken(t, key, "k1", claims)
+	}
+	emptyAudience := func() string {
+		claims := testClaims(time.Hour)
+		claims["aud"] = []string{}
+		return signTestToken(t, key, "k1", claims)
+	}
+
+	strict := middleware.NewJWTAuthenticator(testAudience, testIssuer, jwksServer.URL, nil)
+	rec := serveAuthenticated(strict, "GET", "/", without("aud"))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), "invalid audience")
+	assert.Equal(t, http.StatusUnauthorized, serveAuthenticated(strict, "GET", "/", emptyAudience()).Code)
+	rec = serveAuthenticated(strict, "GET", "/", without("iss"))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), "invalid issuer")
+
+	lenient := middleware.NewJWTAuthenticatorWithOptions(middleware.JWTAuthenticatorOptions{
+		Audience:             testAudience,
+		AllowMissingAudience: true,
+		Issuer:               testIssuer,
+		AllowMissingIssuer:   true,
+		JwksURL:              jwksServer.URL,
+	})
+	assert.Equal(t, http.StatusOK, serveAuthenticated(lenient, "GET", "/", without("aud")).Code)
+	assert.Equal(t, http.StatusOK, serveAuthenticated(lenient, "GET", "/", without("iss")).Code)
+	claims := testClaims(time.Hour)
+	claims["aud"] = "other"
+	assert.Equal(t, http.StatusUnauthorized, serveAuthenticated(lenient, "GET", "/", signTestToken(t, key, "k1", claims)).Code,
+		"a present, but wrong audience is still rejected")
+}
+
+func TestJWTAuthenticatorPublicPaths(t *testing.T) {
+	auth := middleware.NewJWTAuthenticatorWithOptions(middleware.JWTAuthenticatorOptions{
+		Audience:          testAudience,
+		Issuer:            testIssuer,
+		JwksURL:           "http://127.0.0.1:1/jwks.json",
+		PublicURLPrefixes: []string{"/pub", "/static/"},
+		PublicURLPatterns: []*regexp.Regexp{regexp.MustCompile(`^/users/[^/]+/public$`)},
+	})
+	for path, public := range map[string]bool{
+		"/pub":                  true,
+		"/pub/docs":             true,
+		"/public":               false,
+		"/pubs/1":               false,
+		"/static/app.js":        true,
+		"/static":               false,
+		"/users/alice/public":   true,
+		"/users/alice/public/x": false,
+		"/users/public":         false,
+		"/private":              false,
+	} {
+		expected := http.StatusUnauthorized
+		if public {
+			expected = http.StatusOK
+		}
+		assert.Equal(t, expected, serveAuthenticated(auth, "GET", path, "").Code, path)
+	}
+}
+
+func TestJWTAuthenticatorPublicURLMethods(t *testing.T) {
+	auth := middleware.NewJWTAuthenticatorWithOptions(middleware.JWTAuthenticatorOptions{
+		Audience: testAudience,
+		Issuer:   testIssuer,
+		JwksURL:  "http://127.0.0.1:1/jwks.json",
+		PublicURLs: []middleware.PublicURL{
+			{Prefix: "/articles", Methods: []string{"GET", "head"}},
+			{Prefix: "/status"},
+		},
+	})
+	assert.Equal(t, http.StatusOK, serveAuthenticated(auth, "GET", "/articles/1", "").Code)
+	assert.Equal(t, http.StatusOK, serveAuthenticated(auth, "HEAD", "/articles", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, serveAuthenticated(auth, "POST", "/articles", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, serveAuthenticated(auth, "DELETE", "/articles/1", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, serveAuthenticated(auth, "GET", "/articles-admin", "").Code)
+	assert.Equal(t, http.StatusOK, serveAuthenticated(auth, "POST", "/status", "").Code)
+}
+
+func TestJWTAuthenticatorWWWAuthenticate(t *testing.T) {
+	key := newTestKey(t)
+	jwksServer := newJwksTestServer(map[string]*rsa.PublicKey{"k1": &key.PublicKey})
+	defer jwksServer.Close()
+	auth := middleware.NewJWTAuthenticator(testAudience, testIssuer, jwksServer.URL, nil)
+	wrongAudience := testClaims(time.Hour)
+	wrongAudience["aud"] = "other"
+
+	rec := serveAuthenticated(auth, "GET", "/", "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "Bearer", rec.Header().Get("WWW-Authenticate"))
+
+	rec = serveAuthenticated(auth, "GET", "/", signTestToken(t, key, "k1", wrongAudience))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, `Bearer error="invalid_token", error_description="invalid audience"`, rec.Header().Get("WWW-Authenticate"))
+
+	rec = serveAuthenticated(auth, "GET", "/", signTestToken(t, key, "k1", testClaims(-time.Hour)))
+	assert.Equal(t, `Bearer error="invalid_token", error_description="Token is expired"`, rec.Header().Get("WWW-Authenticate"))
+
+	handler := auth.GetHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, `Bearer error="invalid_request", error_description="Authorization header format must be Bearer {token}"`,
+		rec.Header().Get("WWW-Authenticate"))
+}
+
+func TestJWTAuthenticatorJSONErrors(t *testing.T) {
+	key := newTestKey(t)
+	jwksServer := newJwksTestServer(map[string]*rsa.PublicKey{"k1": &key.PublicKey})
+	defer jwksServer.Close()
+	auth := middleware.NewJWTAuthenticator(testAudience, testIssuer, jwksServer.URL, nil)
+	handler := chimiddleware.RequestID(auth.GetHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	serve := func(token string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		body := map[string]interface{}{}
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		return rec, body
+	}
+
+	rec, body := serve(signTestToken(t, key, "k1", testClaims(-time.Hour)))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "application/json; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "Authentication failed.", body["status"])
+	assert.Equal(t, "Token is expired", body["error"])
+	assert.NotEmpty(t, body["request_id"])
+
+	jwksServer.setStatus(http.StatusInternalServerError)
+	auth = middleware.NewJWTAuthenticator(testAudience, testIssuer, jwksServer.URL, nil)
+	handler = chimiddleware.RequestID(auth.GetHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	rec, body = serve(signTestToken(t, key, "k1", testClaims(time.Hour)))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "can't verify token signature", body["error"], "key loading details must not leak")
+	assert.NotContains(t, rec.Header().Get("WWW-Authenticate"), "JWKS")
+}
+
+func TestJwksKeyLoaderOfflineSources(t *testing.T) {
+	key1, key2 := newTestKey(t), newTestKey(t)
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatalf("Can't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	jwksFile := filepath.Join(dir, "jwks.json")
+	writeJwks := func(keys map[string]*rsa.PublicKey) {
+		data, _ := json.Marshal(jwksDocument(keys))
+		if err := ioutil.WriteFile(jwksFile, data, 0600); err != nil {
+			t.Fatalf("Can't write JWKS file: %v", err)
+		}
+	}
+
+	writeJwks(map[string]*rsa.PublicKey{"k1": &key1.PublicKey})
+	fileLoader := middleware.NewJwksKeyLoaderWithOptions(middleware.JwksKeyLoaderOptions{JwksFile: jwksFile})
+	loaded, err := fileLoader.GetPublicKey("k1")
+	assert.Nil(t, err)
+	assert.Equal(t, &key1.PublicKey, loaded)
+	writeJwks(map[string]*rsa.PublicKey{"k2": &key2.PublicKey})
+	fileLoader.Reload()
+	loaded, err = fileLoader.GetPublicKey("k2")
+	assert.Nil(t, err)
+	assert.Equal(t, &key2.PublicKey, loaded, "Reload must re-read the file")
+	_, err = fileLoader.GetPublicKey("k1")
+	assert.NotNil(t, err)
+
+	der, err := x509.MarshalPKIXPublicKey(&key1.PublicKey)
+	if err != nil {
+		t.Fatalf("Can't marshal public key: %v", err)
+	}
+	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	auth := middleware.NewJWTAuthenticatorWithOptions(middleware.JWTAuthenticatorOptions{
+		Audience:   testAudience,
+		Issuer:     testIssuer,
+		JwksInline: pemKey,
+	})
+	assert.Equal(t, http.StatusOK, serveAuthenticated(auth, "GET", "/", signTestToken(t, key1, "any", testClaims(time.Hour))).Code)
+	assert.Equal(t, http.StatusUnauthorized, serveAuthenticated(auth, "GET", "/", signTestToken(t, key2, "any", testClaims(time.Hour))).Code)
+
+	// a JWKS key without ID isn't used for tokens with other key IDs, unlike a PEM key
+	noKid, _ := json.Marshal(jwksDocument(map[string]*rsa.PublicKey{"": &key1.PublicKey}))
+	jwksLoader := middleware.NewJwksKeyLoaderWithOptions(middleware.JwksKeyLoaderOptions{JwksInline: string(noKid)})
+	loaded, err = jwksLoader.GetPublicKey("")
+	assert.Nil(t, err)
+	assert.Equal(t, &key1.PublicKey, loaded)
+	_, err = jwksLoader.GetPublicKey("any")
+	assert.NotNil(t, err)
+
+	missing := middleware.NewJwksKeyLoaderWithOptions(middleware.JwksKeyLoaderOptions{JwksFile: filepath.Join(dir, "missing.json")})
+	_, err = missing.GetPublicKey("k1")
+	assert.NotNil(t, err)
+}
+
+func TestJwksKeyLoaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slowServer.Close()
+	defer close(release)
+
+	loader := middleware.NewJwksKeyLoaderWithOptions(middleware.JwksKeyLoaderOptions{
+		JwksURL:    slowServer.URL,
+		HTTPClient: &http.Client{Timeout: 100 * time.Millisecond},
+	})
+	start := time.Now()
+	_, err := loader.GetPublicKey("k1")
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < 2*time.Second, "JWKS fetch must time out promptly")
+}
+
+func TestJwksKeyLoaderRetriesFailedLoad(t *testing.T) {
+	key := newTestKey(t)
+	jwksServer := newJwksTestServer(map[string]*rsa.PublicKey{"k1": &key.PublicKey})
+	defer jwksServer.Close()
+	loader := middleware.NewJwksKeyLoaderWithOptions(middleware.JwksKeyLoaderOptions{
+		JwksURL:        jwksServer.URL,
+		FailureBackoff: -1,
+	})
+
+	jwksServer.setStatus(http.StatusServiceUnavailable)
+	_, err := loader.GetPublicKey("k1")
+	assert.NotNil(t, err)
+
+	jwksServer.setStatus(http.StatusOK)
+	loaded, err := loader.GetPublicKey("k1")
+	assert.Nil(t, err, "a failed load must not be cached")
+	assert.Equal(t, &key.PublicKey, loaded)
+	assert.Equal(t, 2, jwksServer.fetchCount())
+
+	_, err = loader.GetPublicKey("k1")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, jwksServer.fetchCount(), "a successful load is cached")
+	loader.Reload()
+	_, err = loader.GetPublicKey("k1")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, jwksServer.fetchCount(), "Reload makes the next call fetch the keys")
+}
+
+func TestJwksKeyLoaderFailureBackoff(t *testing.T) {
+	key := newTestKey(t)
+	jwksServer := newJwksTestServer(map[string]*rsa.PublicKey{"k1": &key.PublicKey})
+	defer jwksServer.Close()
+	loader := middleware.NewJwksKeyLoaderWithOptions(middleware.JwksKeyLoaderOptions{
+		JwksURL:        jwksServer.URL,
+		FailureBackoff: time.Hour,
+	})
+
+	jwksServer.setStatus(http.StatusServiceUnavailable)
+	_, firstErr := loader.GetPublicKey("k1")
+	assert.NotNil(t, firstErr)
+	// during the backoff, calls fail with the same error without fetching
+	jwksServer.setStatus(http.StatusOK)
+	for i := 0; i < 5; i++ {
+		_, err := loader.GetPublicKey("k1")
+		assert.Equal(t, firstErr, err)
+	}
+	assert.Equal(t, 1, jwksServer.fetchCount())
+}
+
+func TestJWTAuthenticatorAuthErrorReasons(t *testing.T) {
+	key, otherKey := newTestKey(t), newTestKey(t)
+	jwksServer := newJwksTestServer(map[string]*rsa.PublicKey{"k1": &key.PublicKey})
+	defer jwksServer.Close()
+	auth := middleware.NewJWTAuthenticator(testAudience, testIssuer, jwksServer.URL, nil)
+	withClaim := func(name string, value interface{}) jwt.MapClaims {
+		claims := testClaims(time.Hour)
+		claims[name] = value
+		return claims
+	}
+	reason := func(authorization string) middleware.AuthErrorReason {
+		req := httptest.NewRequest("GET", "/", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		_, err := auth.ValidateRequest(req)
+		authErr, ok := err.(*middleware.AuthError)
+		if !assert.True(t, ok, "expected *AuthError, got %v", err) {
+			return -1
+		}
+		return authErr.Reason
+	}
+
+	assert.Equal(t, middleware.AuthReasonMissingToken, reason(""))
+	assert.Equal(t, middleware.AuthReasonMalformed, reason("Basic dXNlcjpwYXNz"))
+	assert.Equal(t, middleware.AuthReasonMalformed, reason("Bearer not-a-jwt"))
+	assert.Equal(t, middleware.AuthReasonInvalidAudience, reason("Bearer "+signTestToken(t, key, "k1", withClaim("aud", "other"))))
+	assert.Equal(t, middleware.AuthReasonInvalidIssuer, reason("Bearer "+signTestToken(t, key, "k1", withClaim("iss", "other"))))
+	assert.Equal(t, middleware.AuthReasonKeyNotFound, reason("Bearer "+signTestToken(t, key, "k2", testClaims(time.Hour))))
+	assert.Equal(t, middleware.AuthReasonInvalidSignature, reason("Bearer "+signTestToken(t, otherKey, "k1", testClaims(time.Hour))))
+	assert.Equal(t, middleware.AuthReasonExpired, reason("Bearer "+signTestToken(t, key, "k1", testClaims(-time.Hour))))
+	assert.Equal(t, middleware.AuthReasonNotValidYet,
+		reason("Bearer "+signTestToken(t, key, "k1", withClaim("nbf", time.Now().Add(time.Hour).Unix()))))
+	jwksServer.setStatus(http.StatusInternalServerError)
+	auth = middleware.NewJWTAuthenticator(testAudience, testIssuer, jwksServer.URL, nil)
+	assert.Equal(t, middleware.AuthReasonKeyUnavailable, reason("Bearer "+signTestToken(t, key, "k1", testClaims(time.Hour))))
+	assert.Equal(t, "key_unavailable", middleware.AuthReasonKeyUnavailable.String())
+
+	token, err := middleware.NewJWTAuthenticator(testAudience, testIssuer, jwksServer.URL, nil).ValidateRequest(
+		httptest.NewRequest("GET", "/", nil))
+	assert.Nil(t, token)
+	assert.NotNil(t, err)
+}
+
+func TestJWTAuthenticatorIntrospection(t *testing.T) {
+	var calls int32
+	var status int32 = http.StatusOK
+	introspection := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if code := int(atomic.LoadInt32(&status)); code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		clientID, clientSecret, ok := r.BasicAuth()
+		if r.Method != http.MethodPost || !ok || clientID != "my-api" || clientSecret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		response := map[string]interface{}{"active": false}
+		switch r.PostFormValue("token") {
+		case "active-token":
+			response = testClaims(time.Hour)
+			response["active"] = true
+		case "other-audience":
+			response = testClaims(time.Hour)
+			response["active"] = true
+			response["aud"] = "other"
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer introspection.Close()
+	auth := middleware.NewJWTAuthenticatorWithOptions(middleware.JWTAuthenticatorOptions{
+		Audience:         testAudience,
+		Issuer:           testIssuer,
+		IntrospectionURL: introspection.URL,
+		ClientID:         "my-api",
+		ClientSecret:     "s3cret",
+	})
+	reason := func(rawToken string) middleware.AuthErrorReason {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+rawToken)
+		token, err := auth.ValidateRequest(req)
+		if err == nil {
+			assert.Equal(t, "test-user", token.Claims.(jwt.MapClaims)["sub"])
+			return -1
+		}
+		return err.(*middleware.AuthError).Reason
+	}
+
+	assert.Equal(t, middleware.AuthErrorReason(-1), reason("active-token"))
+	assert.Equal(t, middleware.AuthReasonInactive, reason("revoked-token"))
+	assert.Equal(t, middleware.AuthReasonInvalidAudience, reason("other-audience"))
+	assert.EqualValues(t, 3, atomic.LoadInt32(&calls))
+
+	// active tokens are cached, so they're accepted even when the endpoint fails
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	assert.Equal(t, middleware.AuthErrorReason(-1), reason("active-token"))
+	assert.EqualValues(t, 3, atomic.LoadInt32(&calls))
+	// inactive ones are not, and failures are rejected without internal details
+	assert.Equal(t, middleware.AuthReasonIntrospectionFailed, reason("revoked-token"))
+	rec := serveAuthenticated(auth, "GET", "/", "revoked-token")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "503")
+	assert.EqualValues(t, 5, atomic.LoadInt32(&calls))
+}
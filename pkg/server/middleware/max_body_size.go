@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/render"
+)
+
+// NewMaxBodySize returns a middleware limiting request bodies to maxBytes. Requests with
+// a larger Content-Length are rejected with 413 right away. Bodies without a known length
+// are wrapped in http.MaxBytesReader, so handlers get an error when reading past the limit
+// and should respond with ErrRequestTooLarge.
+func NewMaxBodySize(maxBytes int64) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > maxBytes {
+				render.Render(w, r, ErrRequestTooLarge(fmt.Errorf("request body is larger than %d bytes", maxBytes)))
+				return
+			}
+			if r.Body != nil {
+				r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+// MethodOverrideHeader is the header carrying the HTTP method that should be used instead
+// of POST
+const MethodOverrideHeader = "X-HTTP-Method-Override"
+
+// overridableMethods lists HTTP methods a POST request can be overridden to
+var overridableMethods = map[string]bool{
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// NewMethodOverride returns a middleware, which changes the method of POST requests to the
+// one passed in the X-HTTP-Method-Override header, for clients behind proxies allowing only
+// GET and POST. Only PUT, PATCH and DELETE are accepted as overrides; the header is ignored
+// for other methods and values. It has to be installed before routing takes place.
+func NewMethodOverride() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost {
+				override := strings.ToUpper(strings.TrimSpace(r.Header.Get(MethodOverrideHeader)))
+				if overridableMethods[override] {
+					r.Method = override
+				}
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
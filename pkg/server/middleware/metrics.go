@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// DefaultMetricsPath is the default path of the Prometheus metrics endpoint
+	DefaultMetricsPath = "/metrics"
+	// unknownRoutePattern is used as the path label of requests that didn't match any route
+	unknownRoutePattern = "unknown"
+	// otherMethod is used as the method label of requests with a non-standard method
+	otherMethod = "OTHER"
+)
+
+// knownMethods are the request methods recorded as they are in the method label
+var knownMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// Metrics records Prometheus metrics of served HTTP requests
+type Metrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	inFlight prometheus.Gauge
+}
+
+// NewMetrics creates request metrics and registers them, together with the Go runtime
+// and process collectors, in a new Prometheus registry
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Number of served HTTP requests.",
+		}, []string{"method", "path", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Duration of served HTTP requests.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "path"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "Number of HTTP requests being served.",
+		}),
+	}
+	m.registry.MustRegister(m.requests, m.duration, m.inFlight,
+		prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	return m
+}
+
+// Registry returns the Prometheus registry with the request metrics, which can be used
+// to register application specific metrics
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// GetHandler returns a middleware recording metrics of requests. The path label is the
+// chi route pattern, not the raw URL, to keep the cardinality of metrics low.
+func (m *Metrics) GetHandler() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			m.inFlight.Inc()
+			defer m.inFlight.Dec()
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+
+			path := unknownRoutePattern
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				path = rctx.RoutePattern()
+			}
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			// clients can send any method, so unknown ones are grouped to keep the cardinality low
+			method := r.Method
+			if !knownMethods[method] {
+				method = otherMethod
+			}
+			m.requests.WithLabelValues(method, path, strconv.Itoa(status)).Inc()
+			m.duration.WithLabelValues(method, path).Observe(time.Since(start).Seconds())
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// NewMetricsEndpoint returns a middleware serving the metrics from the registry on GET
+// requests to path, so the endpoint is handled before any authentication middleware
+func NewMetricsEndpoint(path string, registry *prometheus.Registry) func(next http.Handler) http.Handler {
+	handler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if (r.Method == http.MethodGet || r.Method == http.MethodHead) && r.URL.Path == path {
+				handler.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
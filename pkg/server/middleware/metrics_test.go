@@ -0,0 +1,30 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/piontec/go-chi-middleware-server/pkg/server/middleware"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsMethodLabel(t *testing.T) {
+	metrics := middleware.NewMetrics()
+	r := chi.NewRouter()
+	r.Use(middleware.NewMetricsEndpoint(middleware.DefaultMetricsPath, metrics.Registry()))
+	r.Use(metrics.GetHandler())
+	r.HandleFunc("/items", func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, method := range []string{"GET", "FOO", "BAR", "PROPFIND"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/items", nil))
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", middleware.DefaultMetricsPath, nil))
+	assert.Contains(t, rec.Body.String(), `http_requests_total{method="GET",path="/items",status="200"} 1`)
+	assert.Contains(t, rec.Body.String(), `http_requests_total{method="OTHER",path="unknown",status="405"} 3`)
+	assert.NotContains(t, rec.Body.String(), `method="FOO"`)
+}
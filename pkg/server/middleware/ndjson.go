@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ContentTypeNDJSON is the content type of newline-delimited JSON streams
+const ContentTypeNDJSON = "application/x-ndjson"
+
+// StreamNDJSON writes every record received from ch as a single line of JSON and flushes
+// it to the client immediately, so large result sets can be streamed without buffering.
+// It returns when ch is closed or when encoding or writing a record fails. The server's
+// WriteTimeout, 60s by default, still ends the whole stream, so streams that can last longer
+// need a server with a higher WriteTimeout, or 0 with DisableDefaultTimeouts.
+func StreamNDJSON(w http.ResponseWriter, ch <-chan interface{}) error {
+	w.Header().Set("Content-Type", ContentTypeNDJSON)
+	flusher, canFlush := w.(http.Flusher)
+	for record := range ch {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(append(line, '\n')); err != nil {
+			return err
+		}
+		if canFlush {
+			flusher.Flush()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// publicHandler marks a route handler, which doesn't require authentication
+type publicHandler struct {
+	http.Handler
+}
+
+// Public marks the route handler as public, so the JwtAuthenticator doesn't require
+// authentication for the route, like r.Method("GET", "/docs", msm.Public(docsHandler)).
+// Routes with http.HandlerFunc handlers can use the PublicRoute middleware instead.
+func Public(handler http.Handler) http.Handler {
+	return publicHandler{handler}
+}
+
+// PublicRoute is a marker middleware making the route public, like Public, for routes
+// registered with handler funcs: r.With(msm.PublicRoute).Get("/docs", docs). It has to be
+// passed to With() as it is, not wrapped in other middleware.
+func PublicRoute(next http.Handler) http.Handler {
+	return next
+}
+
+// publicRoutes returns "METHOD pattern" keys of all the routes marked as public
+func publicRoutes(routes chi.Routes) map[string]bool {
+	public := map[string]bool{}
+	publicRoutePtr := reflect.ValueOf(PublicRoute).Pointer()
+	chi.Walk(routes, func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		isPublic := false
+		if _, ok := handler.(publicHandler); ok {
+			isPublic = true
+		}
+		for _, mw := range middlewares {
+			if reflect.ValueOf(mw).Pointer() == publicRoutePtr {
+				isPublic = true
+			}
+		}
+		if isPublic {
+			public[method+" "+cleanRoutePattern(route)] = true
+		}
+		return nil
+	})
+	return public
+}
+
+// cleanRoutePattern removes wildcards of mounted routers from the pattern, like chi does
+// for patterns of matched routes
+func cleanRoutePattern(pattern string) string {
+	for strings.Contains(pattern, "/*/") {
+		pattern = strings.Replace(pattern, "/*/", "/", -1)
+	}
+	return pattern
+}
+
+// matchedRoutePattern returns the pattern of the route the request is routed to
+func matchedRoutePattern(routes chi.Routes, r *http.Request) (string, bool) {
+	routePath := r.URL.RawPath
+	if routePath == "" {
+		routePath = r.URL.Path
+	}
+	rctx := chi.NewRouteContext()
+	if !routes.Match(rctx, r.Method, routePath) {
+		return "", false
+	}
+	return rctx.RoutePattern(), true
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/render"
+)
+
+const (
+	// DefaultMaxQueryParams is the default limit of query parameters in a single request
+	DefaultMaxQueryParams = 100
+	// DefaultMaxQueryValueLength is the default limit of the length of a single query parameter value
+	DefaultMaxQueryValueLength = 2048
+)
+
+// NewQueryLimits returns a middleware, which rejects requests with more than maxParams query
+// parameter values or with any value longer than maxValueLength with a 400 response.
+// Zero limits are replaced with DefaultMaxQueryParams and DefaultMaxQueryValueLength.
+func NewQueryLimits(maxParams, maxValueLength int) func(next http.Handler) http.Handler {
+	if maxParams <= 0 {
+		maxParams = DefaultMaxQueryParams
+	}
+	if maxValueLength <= 0 {
+		maxValueLength = DefaultMaxQueryValueLength
+	}
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.RawQuery == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			query, err := url.ParseQuery(r.URL.RawQuery)
+			if err != nil {
+				render.Render(w, r, ErrInvalidRequest(fmt.Errorf("invalid query string: %v", err)))
+				return
+			}
+			count := 0
+			for key, values := range query {
+				count += len(values)
+				if count > maxParams {
+					render.Render(w, r, ErrInvalidRequest(fmt.Errorf("too many query parameters, the limit is %d", maxParams)))
+					return
+				}
+				for _, value := range values {
+					if len(value) > maxValueLength {
+						render.Render(w, r, ErrInvalidRequest(fmt.Errorf("value of query parameter %q is too long, the limit is %d",
+							key, maxValueLength)))
+						return
+					}
+				}
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/render"
+	"golang.org/x/time/rate"
+)
+
+// RateLimitKeyFunc returns the key requests are rate limited by, like the client's IP
+type RateLimitKeyFunc func(r *http.Request) string
+
+// KeyByIP is a RateLimitKeyFunc returning the client's IP. Use it after chi's RealIP
+// middleware to get the IP of clients behind proxies.
+func KeyByIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// rateLimiterEntry is the token bucket of a single key
+type rateLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiter is a token bucket rate limiter with a separate bucket for every key
+type RateLimiter struct {
+	lock      sync.Mutex
+	limit     rate.Limit
+	burst     int
+	keyFunc   RateLimitKeyFunc
+	entries   map[string]*rateLimiterEntry
+	idleTTL   time.Duration
+	lastSweep time.Time
+}
+
+// CheckRateLimit returns an error if the rate limit can't work: requests and interval have
+// to be positive and burst can't be negative
+func CheckRateLimit(requests int, interval time.Duration, burst int) error {
+	if requests <= 0 {
+		return fmt.Errorf("rate limit requests must be positive, got %d", requests)
+	}
+	if interval <= 0 {
+		return fmt.Errorf("rate limit interval must be positive, got %v", interval)
+	}
+	if burst < 0 {
+		return fmt.Errorf("rate limit burst can't be negative, got %d", burst)
+	}
+	return nil
+}
+
+// NewRateLimiter returns a rate limiter allowing on average requests per interval for
+// every key returned by keyFunc, with bursts of up to burst requests. If keyFunc is nil,
+// KeyByIP is used; if burst is zero, it's equal to requests. It panics if the limit is
+// invalid, see CheckRateLimit.
+func NewRateLimiter(requests int, interval time.Duration, burst int, keyFunc RateLimitKeyFunc) *RateLimiter {
+	if err := CheckRateLimit(requests, interval, burst); err != nil {
+		panic(err)
+	}
+	if burst <= 0 {
+		burst = requests
+	}
+	if keyFunc == nil {
+		keyFunc = KeyByIP
+	}
+	limit := rate.Limit(float64(requests) / interval.Seconds())
+	return &RateLimiter{
+		limit:   limit,
+		burst:   burst,
+		keyFunc: keyFunc,
+		entries: make(map[string]*rateLimiterEntry),
+		// after that time an idle bucket is full again, so it can be dropped
+		idleTTL:   time.Duration(float64(burst) / float64(limit) * float64(time.Second)),
+		lastSweep: time.Now(),
+	}
+}
+
+// GetHandler returns a middleware rejecting requests over the limit with 429 and the
+// Retry-After header
+func (l *RateLimiter) GetHandler() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			reservation := l.limiter(l.keyFunc(r)).Reserve()
+			if delay := reservation.Delay(); delay > 0 {
+				reservation.Cancel()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+				render.Render(w, r, ErrTooManyRequests(errors.New("rate limit exceeded")))
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// limiter returns the token bucket of the key, dropping buckets of idle keys from time to time
+func (l *RateLimiter) limiter(key string) *rate.Limiter {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastSweep) > l.idleTTL {
+		for k, entry := range l.entries {
+			if now.Sub(entry.lastSeen) > l.idleTTL {
+				delete(l.entries, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	entry, found := l.entries[key]
+	if !found {
+		entry = &rateLimiterEntry{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.entries[key] = entry
+	}
+	entry.lastSeen = now
+	return entry.limiter
+}
@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/render"
+)
+
+// readOnlyMethods lists HTTP methods that are allowed to pass through the ReadOnlyGuard
+var readOnlyMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+
+// NewReadOnlyGuard returns a middleware, which rejects all requests using HTTP methods
+// other than GET, HEAD and OPTIONS with a 405 response. It's useful for read-replica
+// deployments, where no write request should ever reach a handler.
+func NewReadOnlyGuard() func(next http.Handler) http.Handler {
+	allowHeader := strings.Join(readOnlyMethods, ", ")
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			for _, method := range readOnlyMethods {
+				if r.Method == method {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			w.Header().Set("Allow", allowHeader)
+			render.Render(w, r, ErrMethodNotAllowed(fmt.Errorf("method %s is not allowed in read-only mode", r.Method)))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
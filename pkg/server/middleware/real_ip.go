@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// NewTrustedRealIP returns a middleware, which sets the request's RemoteAddr to the client
+// IP from the X-Forwarded-For or X-Real-IP headers, like chi's RealIP, but only when the
+// immediate peer is one of the trusted proxies; otherwise the headers are ignored, so
+// clients can't spoof their IP. X-Forwarded-For is read from the right, skipping trusted
+// proxies, so the first untrusted address is used. X-Real-IP is used only for requests
+// without X-Forwarded-For, as proxies appending to X-Forwarded-For usually pass X-Real-IP
+// sent by the client through untouched.
+func NewTrustedRealIP(trustedProxies []*net.IPNet) func(next http.Handler) http.Handler {
+	isTrusted := func(ip net.IP) bool {
+		for _, network := range trustedProxies {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if isTrusted(remoteIP(r)) {
+				if ip := forwardedIP(r, isTrusted); ip != "" {
+					r.RemoteAddr = ip
+				}
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// remoteIP returns the IP of the request's immediate peer
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// forwardedIP returns the client IP set by trusted proxies, or "" if there is none
+func forwardedIP(r *http.Request, isTrusted func(net.IP) bool) string {
+	if len(r.Header["X-Forwarded-For"]) == 0 {
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+			return ip.String()
+		}
+		return ""
+	}
+	var client string
+	addrs := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(addrs[i]))
+		if ip == nil {
+			break
+		}
+		client = ip.String()
+		if !isTrusted(ip) {
+			break
+		}
+	}
+	return client
+}
@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+)
+
+// NewRecoverer returns a middleware, which recovers from panics in handlers like chi's
+// middleware.Recoverer, but responds with the JSON ErrInternal error. The panic is logged
+// with the request's log entry, see StructuredLoggerEntry.Panic. Upgraded connections,
+// like websockets, get no response body.
+func NewRecoverer() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				rvr := recover()
+				if rvr == nil {
+					return
+				}
+				if rvr == http.ErrAbortHandler {
+					// let net/http abort the response
+					panic(rvr)
+				}
+				if logEntry := middleware.GetLogEntry(r); logEntry != nil {
+					logEntry.Panic(rvr, debug.Stack())
+				} else {
+					middleware.PrintPrettyStack(rvr)
+				}
+				if r.Header.Get("Connection") == "Upgrade" {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				render.Render(w, r, ErrInternal(fmt.Errorf("panic: %v", rvr)))
+			}()
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
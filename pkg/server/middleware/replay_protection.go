@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	// replayCacheSweepInterval is how often MemoryReplayCache drops expired token IDs
+	replayCacheSweepInterval = time.Minute
+	// DefaultReplayLeeway is the default of ReplayProtectionOptions.Leeway
+	DefaultReplayLeeway = 5 * time.Minute
+)
+
+// ReplayCache records IDs of already used tokens. Implementations backed by an external
+// store, like Redis, make the replay protection work across many server instances.
+type ReplayCache interface {
+	// Add records the token ID until expiresAt. It returns false if the ID is already
+	// recorded and not yet expired, i.e. the token is being replayed.
+	Add(ctx context.Context, jti string, expiresAt time.Time) (bool, error)
+}
+
+// MemoryReplayCache is an in-memory ReplayCache keeping token IDs until their token expires.
+// It protects only the process it runs in.
+type MemoryReplayCache struct {
+	lock      sync.Mutex
+	entries   map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewMemoryReplayCache returns an empty in-memory ReplayCache
+func NewMemoryReplayCache() *MemoryReplayCache {
+	return &MemoryReplayCache{
+		entries:   make(map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// Add implements ReplayCache, dropping expired token IDs from time to time
+func (c *MemoryReplayCache) Add(_ context.Context, jti string, expiresAt time.Time) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	if now.Sub(c.lastSweep) > replayCacheSweepInterval {
+		for id, exp := range c.entries {
+			if !now.Before(exp) {
+				delete(c.entries, id)
+			}
+		}
+		c.lastSweep = now
+	}
+	if exp, found := c.entries[jti]; found && now.Before(exp) {
+		return false, nil
+	}
+	c.entries[jti] = expiresAt
+	return true, nil
+}
+
+// ReplayProtectionOptions configures the ReplayProtection middleware
+type ReplayProtectionOptions struct {
+	// Cache records the IDs of used tokens; defaults to a new MemoryReplayCache, which only
+	// detects replays within a single process; use a cache backed by an external store when
+	// running many instances
+	Cache ReplayCache
+	// Leeway is how long token IDs are kept after their token expires. The authenticator
+	// accepts tokens until 'exp' plus its ClockSkew, so the leeway must not be shorter than
+	// ClockSkew, otherwise tokens can be replayed in between. Defaults to DefaultReplayLeeway;
+	// a negative value keeps the IDs only until 'exp'.
+	Leeway time.Duration
+}
+
+// NewReplayProtection returns a middleware, which rejects reused JWT tokens with a 401
+// response, by recording their 'jti' claim in cache until the token expires, plus
+// DefaultReplayLeeway. Tokens without 'jti' or 'exp' claims are rejected as well. It has to
+// be used after the JWT authenticator and is meant to be mounted per route, like
+// r.With(NewReplayProtection(nil)).Post(...). If cache is nil, a MemoryReplayCache is used.
+func NewReplayProtection(cache ReplayCache) func(next http.Handler) http.Handler {
+	return NewReplayProtectionWithOptions(ReplayProtectionOptions{Cache: cache})
+}
+
+// NewReplayProtectionWithOptions returns the ReplayProtection middleware configured with
+// ReplayProtectionOptions
+func NewReplayProtectionWithOptions(options ReplayProtectionOptions) func(next http.Handler) http.Handler {
+	cache := options.Cache
+	if cache == nil {
+		cache = NewMemoryReplayCache()
+	}
+	leeway := options.Leeway
+	if leeway == 0 {
+		leeway = DefaultReplayLeeway
+	} else if leeway < 0 {
+		leeway = 0
+	}
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			token, ok := GetToken(r)
+			if !ok {
+				render.Render(w, r, ErrAuth(errors.New("authentication token is required")))
+				return
+			}
+			claims, _ := token.Claims.(jwt.MapClaims)
+			jti, _ := claims["jti"].(string)
+			if jti == "" {
+				render.Render(w, r, ErrAuth(errors.New("token has no 'jti' claim")))
+				return
+			}
+			expiresAt, ok := claimTime(claims, "exp")
+			if !ok {
+				render.Render(w, r, ErrAuth(errors.New("token has no 'exp' claim")))
+				return
+			}
+			added, err := cache.Add(r.Context(), jti, expiresAt.Add(leeway))
+			if err != nil {
+				render.Render(w, r, ErrInternal(err))
+				return
+			}
+			if !added {
+				render.Render(w, r, ErrAuth(errors.New("token was already used")))
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
@@ -0,0 +1,61 @@
+package middleware_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/piontec/go-chi-middleware-server/pkg/server/middleware"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failingReplayCache struct{}
+
+func (failingReplayCache) Add(context.Context, string, time.Time) (bool, error) {
+	return false, errors.New("store unavailable")
+}
+
+func TestReplayProtection(t *testing.T) {
+	serveWith := func(options middleware.ReplayProtectionOptions) func(claims jwt.MapClaims) int {
+		handler := middleware.NewReplayProtectionWithOptions(options)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		return func(claims jwt.MapClaims) int {
+			req := httptest.NewRequest("POST", "/", nil)
+			if claims != nil {
+				token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+				req = req.WithContext(context.WithValue(req.Context(), middleware.CtxJWTKey, token))
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			return rec.Code
+		}
+	}
+	serve := serveWith(middleware.ReplayProtectionOptions{})
+	exp := float64(time.Now().Add(time.Hour).Unix())
+
+	assert.Equal(t, http.StatusOK, serve(jwt.MapClaims{"jti": "a", "exp": exp}))
+	assert.Equal(t, http.StatusUnauthorized, serve(jwt.MapClaims{"jti": "a", "exp": exp}), "replayed token")
+	assert.Equal(t, http.StatusOK, serve(jwt.MapClaims{"jti": "b", "exp": exp}))
+	assert.Equal(t, http.StatusUnauthorized, serve(jwt.MapClaims{"exp": exp}), "missing jti")
+	assert.Equal(t, http.StatusUnauthorized, serve(jwt.MapClaims{"jti": "c"}), "missing exp")
+	assert.Equal(t, http.StatusUnauthorized, serve(nil), "missing token")
+
+	// token IDs are kept after the token expires, as the authenticator may accept it within
+	// its clock skew
+	past := float64(time.Now().Add(-time.Second).Unix())
+	assert.Equal(t, http.StatusOK, serve(jwt.MapClaims{"jti": "d", "exp": past}))
+	assert.Equal(t, http.StatusUnauthorized, serve(jwt.MapClaims{"jti": "d", "exp": past}), "replayed within leeway")
+
+	// the ID of a token expired for longer than the leeway can be used again
+	serve = serveWith(middleware.ReplayProtectionOptions{Leeway: -1})
+	assert.Equal(t, http.StatusOK, serve(jwt.MapClaims{"jti": "e", "exp": past}))
+	assert.Equal(t, http.StatusOK, serve(jwt.MapClaims{"jti": "e", "exp": exp}))
+
+	// cache errors fail closed
+	serve = serveWith(middleware.ReplayProtectionOptions{Cache: failingReplayCache{}})
+	assert.Equal(t, http.StatusInternalServerError, serve(jwt.MapClaims{"jti": "e", "exp": exp}))
+}
@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// RequestCounter counts requests being currently served
+type RequestCounter struct {
+	active int64
+}
+
+// GetHandler returns a middleware counting active requests; it should be the first one
+// in the chain, so all the requests are counted
+func (c *RequestCounter) GetHandler() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&c.active, 1)
+			defer atomic.AddInt64(&c.active, -1)
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// Active returns the number of requests being currently served
+func (c *RequestCounter) Active() int64 {
+	return atomic.LoadInt64(&c.active)
+}
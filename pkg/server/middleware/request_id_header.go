@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// DefaultRequestIDHeader is the default response header with the ID of the request
+const DefaultRequestIDHeader = "X-Request-Id"
+
+// NewRequestIDHeader returns a middleware, which returns the request ID set by chi's
+// RequestID middleware in the named response header, so clients can correlate their
+// requests with server logs. If header is empty, DefaultRequestIDHeader is used.
+func NewRequestIDHeader(header string) func(next http.Handler) http.Handler {
+	if header == "" {
+		header = DefaultRequestIDHeader
+	}
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if reqID := middleware.GetReqID(r.Context()); reqID != "" {
+				w.Header().Set(header, reqID)
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
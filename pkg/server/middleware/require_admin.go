@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/render"
+)
+
+// NewRequireAdmin returns a middleware, which rejects requests with a 403 response unless
+// CtxIsAdminKey is set to true in Context() by the UserInfoSetter. It's meant to be mounted
+// per route, like r.With(NewRequireAdmin()).Delete("/items/{id}", deleteItem).
+func NewRequireAdmin() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if isAdmin, _ := r.Context().Value(CtxIsAdminKey).(bool); !isAdmin {
+				render.Render(w, r, ErrForbidden(errors.New("admin role is required")))
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/render"
+)
+
+// NewRequireJSON returns a middleware, which rejects POST, PUT and PATCH requests with a
+// body that isn't JSON with a 415 response. "application/json" and media types with the
+// "+json" suffix, like "application/merge-patch+json", are accepted with any parameters.
+// Requests without a body are passed through. It only checks the request, the response
+// content type is still set by render.SetContentType.
+func NewRequireJSON() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			contentType := r.Header.Get("Content-Type")
+			if hasBody(r) && isWriteMethod(r.Method) && (contentType == "" || !isJSONContentType(contentType)) {
+				render.Render(w, r, ErrUnsupportedMediaType(errors.New("request body must be JSON")))
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// hasBody checks if the request has a body of known non-zero or unknown length
+func hasBody(r *http.Request) bool {
+	return r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0
+}
+
+// isWriteMethod checks if the method is expected to send a request body
+func isWriteMethod(method string) bool {
+	return method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch
+}
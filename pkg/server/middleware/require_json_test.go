@@ -0,0 +1,46 @@
+package middleware_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/render"
+	"github.com/piontec/go-chi-middleware-server/pkg/server/middleware"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireJSON(t *testing.T) {
+	handler := render.SetContentType(render.ContentTypeJSON)(middleware.NewRequireJSON()(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			render.JSON(w, r, map[string]string{"status": "ok"})
+		})))
+	serve := func(method, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/items", strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("POST", "application/x-www-form-urlencoded", "name=item")
+	assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "application/json")
+	var errBody map[string]string
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &errBody))
+	assert.Equal(t, "request body must be JSON", errBody["error"])
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, serve("PUT", "", `{"name":"item"}`).Code)
+	assert.Equal(t, http.StatusUnsupportedMediaType, serve("PATCH", "text/plain", `{"name":"item"}`).Code)
+	assert.Equal(t, http.StatusOK, serve("POST", "application/json", `{"name":"item"}`).Code)
+	assert.Equal(t, http.StatusOK, serve("POST", "application/json; charset=utf-8", `{"name":"item"}`).Code)
+	assert.Equal(t, http.StatusOK, serve("PATCH", "application/merge-patch+json", `{"name":"item"}`).Code)
+	// requests without a body and reads aren't checked
+	assert.Equal(t, http.StatusOK, serve("POST", "", "").Code)
+	assert.Equal(t, http.StatusOK, serve("GET", "text/plain", "ignored").Code)
+}
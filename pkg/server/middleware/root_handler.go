@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/go-chi/render"
+)
+
+// NewRootHandler returns a middleware, which answers GET and HEAD requests to the root path `/`
+// before they reach any authentication middleware. If redirectURL is not empty, the client is
+// redirected there (e.g. to API docs), otherwise the info payload is returned as JSON.
+func NewRootHandler(redirectURL string, info map[string]interface{}) func(next http.Handler) http.Handler {
+	payload := info
+	if payload == nil {
+		payload = map[string]interface{}{}
+	}
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if redirectURL != "" {
+				http.Redirect(w, r, redirectURL, http.StatusFound)
+				return
+			}
+			render.JSON(w, r, payload)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
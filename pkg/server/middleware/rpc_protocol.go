@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/render"
+)
+
+const (
+	// RPCProtocolGRPCWeb identifies gRPC-Web requests
+	RPCProtocolGRPCWeb = "grpc-web"
+	// RPCProtocolConnect identifies Connect protocol requests
+	RPCProtocolConnect = "connect"
+	// connectProtocolVersionHeader is sent by Connect clients with unary requests
+	connectProtocolVersionHeader = "Connect-Protocol-Version"
+)
+
+// RPCProtocol returns RPCProtocolGRPCWeb or RPCProtocolConnect if the request uses one of
+// these protocols, based on its content type and headers, or an empty string otherwise
+func RPCProtocol(r *http.Request) string {
+	contentType := strings.ToLower(r.Header.Get("Content-Type"))
+	switch {
+	case strings.HasPrefix(contentType, "application/grpc-web"):
+		return RPCProtocolGRPCWeb
+	case strings.HasPrefix(contentType, "application/connect+"), r.Header.Get(connectProtocolVersionHeader) != "":
+		return RPCProtocolConnect
+	}
+	return ""
+}
+
+// NewJSONContentType returns a middleware, which sets JSON as the content type used by
+// render for responses, except for gRPC-Web and Connect requests, which use their own
+// content types
+func NewJSONContentType() func(next http.Handler) http.Handler {
+	setJSON := render.SetContentType(render.ContentTypeJSON)
+	return func(next http.Handler) http.Handler {
+		withJSON := setJSON(next)
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if RPCProtocol(r) != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			withJSON.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
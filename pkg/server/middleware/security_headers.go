@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+const (
+	// DefaultContentTypeOptions is the default value of the X-Content-Type-Options header
+	DefaultContentTypeOptions = "nosniff"
+	// DefaultFrameOptions is the default value of the X-Frame-Options header
+	DefaultFrameOptions = "DENY"
+	// DefaultReferrerPolicy is the default value of the Referrer-Policy header
+	DefaultReferrerPolicy = "no-referrer"
+	// DefaultStrictTransportSecurity is the default value of the Strict-Transport-Security header
+	DefaultStrictTransportSecurity = "max-age=31536000; includeSubDomains"
+)
+
+// SecurityHeadersOptions configures the SecurityHeaders middleware. Empty values of the
+// headers with a default use the default.
+type SecurityHeadersOptions struct {
+	// ContentTypeOptions is the X-Content-Type-Options value; defaults to DefaultContentTypeOptions
+	ContentTypeOptions string
+	// FrameOptions is the X-Frame-Options value; defaults to DefaultFrameOptions
+	FrameOptions string
+	// ReferrerPolicy is the Referrer-Policy value; defaults to DefaultReferrerPolicy
+	ReferrerPolicy string
+	// StrictTransportSecurity is the Strict-Transport-Security value; defaults to
+	// DefaultStrictTransportSecurity. It's sent only in responses to requests served over TLS,
+	// unless AlwaysSendHSTS is set.
+	StrictTransportSecurity string
+	// AlwaysSendHSTS sends Strict-Transport-Security also in responses to plain HTTP requests,
+	// for servers behind a TLS terminating proxy or load balancer, which only reach the server
+	// over plain HTTP. Set it only if clients can't reach the server without TLS.
+	AlwaysSendHSTS bool
+	// ContentSecurityPolicy is the Content-Security-Policy value; the header isn't set if it's empty
+	ContentSecurityPolicy string
+	// OmitHeaders lists the headers, which shouldn't be set at all, like "X-Frame-Options"
+	OmitHeaders []string
+}
+
+// NewSecurityHeaders returns a middleware setting the hardening headers with their defaults
+func NewSecurityHeaders() func(next http.Handler) http.Handler {
+	return NewSecurityHeadersWithOptions(SecurityHeadersOptions{})
+}
+
+// NewSecurityHeadersWithOptions returns the SecurityHeaders middleware configured with
+// SecurityHeadersOptions. The headers are set before the request is handled, so handlers
+// can still override them.
+func NewSecurityHeadersWithOptions(options SecurityHeadersOptions) func(next http.Handler) http.Handler {
+	headers := map[string]string{
+		"X-Content-Type-Options":  valueOrDefault(options.ContentTypeOptions, DefaultContentTypeOptions),
+		"X-Frame-Options":         valueOrDefault(options.FrameOptions, DefaultFrameOptions),
+		"Referrer-Policy":         valueOrDefault(options.ReferrerPolicy, DefaultReferrerPolicy),
+		"Content-Security-Policy": options.ContentSecurityPolicy,
+	}
+	hsts := valueOrDefault(options.StrictTransportSecurity, DefaultStrictTransportSecurity)
+	for _, name := range options.OmitHeaders {
+		name = http.CanonicalHeaderKey(name)
+		delete(headers, name)
+		if name == "Strict-Transport-Security" {
+			hsts = ""
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			for name, value := range headers {
+				if value != "" {
+					w.Header().Set(name, value)
+				}
+			}
+			// HSTS sent over plain HTTP is ignored by browsers, so it's only sent when TLS is
+			// terminated here or, with AlwaysSendHSTS, by a proxy in front of the server
+			if hsts != "" && (r.TLS != nil || options.AlwaysSendHSTS) {
+				w.Header().Set("Strict-Transport-Security", hsts)
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+func valueOrDefault(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,52 @@
+package middleware_test
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/piontec/go-chi-middleware-server/pkg/server/middleware"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	serve := func(handler http.Handler, tlsState *tls.ConnectionState) http.Header {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.TLS = tlsState
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Header()
+	}
+
+	headers := serve(middleware.NewSecurityHeaders()(ok), nil)
+	assert.Equal(t, "nosniff", headers.Get("X-Content-Type-Options"))
+	assert.Equal(t, "DENY", headers.Get("X-Frame-Options"))
+	assert.Equal(t, "no-referrer", headers.Get("Referrer-Policy"))
+	assert.Empty(t, headers.Get("Content-Security-Policy"))
+	// HSTS only over TLS
+	assert.Empty(t, headers.Get("Strict-Transport-Security"))
+	headers = serve(middleware.NewSecurityHeaders()(ok), &tls.ConnectionState{})
+	assert.Equal(t, "max-age=31536000; includeSubDomains", headers.Get("Strict-Transport-Security"))
+
+	// behind a TLS terminating proxy, the requests come over plain HTTP
+	headers = serve(middleware.NewSecurityHeadersWithOptions(middleware.SecurityHeadersOptions{AlwaysSendHSTS: true})(ok), nil)
+	assert.Equal(t, "max-age=31536000; includeSubDomains", headers.Get("Strict-Transport-Security"))
+
+	handler := middleware.NewSecurityHeadersWithOptions(middleware.SecurityHeadersOptions{
+		FrameOptions:          "SAMEORIGIN",
+		ContentSecurityPolicy: "default-src 'none'",
+		OmitHeaders:           []string{"referrer-policy", "Strict-Transport-Security"},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "overridden")
+	}))
+	headers = serve(handler, &tls.ConnectionState{})
+	assert.Equal(t, "SAMEORIGIN", headers.Get("X-Frame-Options"))
+	assert.Equal(t, "default-src 'none'", headers.Get("Content-Security-Policy"))
+	assert.Empty(t, headers.Get("Referrer-Policy"))
+	assert.Empty(t, headers.Get("Strict-Transport-Security"))
+	// handlers can override the headers
+	assert.Equal(t, "overridden", headers.Get("X-Content-Type-Options"))
+}
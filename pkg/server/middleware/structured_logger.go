@@ -2,47 +2,176 @@ package middleware
 
 import (
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // adapted from: https://github.com/go-chi/chi/blob/master/_examples/logging/main.go
 
+// RedactedHeaderValue replaces values of sensitive headers in logs
+const RedactedHeaderValue = "[REDACTED]"
+
+// sensitiveHeaders are never logged with their real values
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Api-Key":           true,
+}
+
+const (
+	// DefaultTimestampField is the name of the request log field with the time the request started
+	DefaultTimestampField = "ts"
+	// DefaultTimestampFormat is the format of the request timestamp
+	DefaultTimestampFormat = time.RFC3339Nano
+)
+
+// LogFormat selects the format of request logs
+type LogFormat int
+
+const (
+	// LogFormatStructured logs "request started" and "request complete" entries with all
+	// the request fields using the logrus logger and its formatter
+	LogFormatStructured LogFormat = iota
+	// LogFormatCombined logs a single line per request in the NCSA combined log format,
+	// written directly to the logger's output. Panics are still logged as logrus entries.
+	// The logger's output is wrapped, so the lines and logrus entries are written one at a time.
+	LogFormatCombined
+)
+
+// combinedLogTimeFormat is the time format of the NCSA combined log format
+const combinedLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
 // LogrusFieldFuncs is a map that sets additional fields in logs (based on keys)
 // using a function acting on the http.Request
 type LogrusFieldFuncs map[string](func(r *http.Request) string)
 
+// LogrusCompletionFieldFuncs is a map that sets additional fields in the request completion
+// log entry (based on keys) using a function acting on the response status, its body length
+// and headers. The request is the one the log entry was created for, so it has no values
+// set to its Context() by handlers.
+type LogrusCompletionFieldFuncs map[string](func(r *http.Request, status, bytes int, header http.Header) string)
+
 // NewStructuredLogger is a simple, but powerful implementation of a custom structured
 // logger backed on logrus. I encourage users to copy it, adapt it and make it their
 // own. Also take a look at https://github.com/pressly/lg for a dedicated pkg based
 // on this work, designed for context-based http routers.
 func NewStructuredLogger(logger *logrus.Logger, extraFields logrus.Fields,
 	extraFieldFuncs LogrusFieldFuncs) func(next http.Handler) http.Handler {
-	return middleware.RequestLogger(&StructuredLogger{
-		Logger:          logger,
+	return NewStructuredLoggerWithOptions(logger, StructuredLoggerOptions{
 		ExtraFields:     extraFields,
 		ExtraFieldFuncs: extraFieldFuncs,
 	})
 }
 
+// StructuredLoggerOptions configures the structured logger middleware
+type StructuredLoggerOptions struct {
+	// ExtraFields are added to every request log entry
+	ExtraFields logrus.Fields
+	// ExtraFieldFuncs compute additional fields from the request
+	ExtraFieldFuncs LogrusFieldFuncs
+	// CompletionFieldFuncs compute additional fields of the completion entry from the response
+	CompletionFieldFuncs LogrusCompletionFieldFuncs
+	// RequestHeaders are names of request headers logged as "header_<name>" fields,
+	// e.g. "X-Tenant" is logged as "header_x_tenant". Values of sensitive headers, like
+	// Authorization or Cookie, are replaced with RedactedHeaderValue.
+	RequestHeaders []string
+	// SkipPaths lists paths of requests logged only at debug level, like health checks. A path
+	// ending with "*" matches all the paths starting with it, e.g. "/debug/*".
+	SkipPaths []string
+	// OmitPanicStack leaves the stack trace out of panic log entries, which then have only
+	// the panic value
+	OmitPanicStack bool
+	// TimestampField is the name of the field with the time the request started, like
+	// "@timestamp"; defaults to DefaultTimestampField
+	TimestampField string
+	// TimestampFormat is the time.Format layout of the timestamp; defaults to DefaultTimestampFormat
+	TimestampFormat string
+	// Format of request logs; structured logrus entries by default
+	Format LogFormat
+	// SampleRate logs only 1 in SampleRate requests, which succeed with a status below 400.
+	// Requests failing with 4xx and 5xx and panics are always logged, but if they weren't
+	// sampled, only with the "request complete" entry. 0 and 1 log all the requests.
+	SampleRate int
+	// OmitRequestStarted leaves out the "request started" entry, so every request is logged
+	// only with the "request complete" entry, which has all the request fields as well
+	OmitRequestStarted bool
+}
+
+// NewStructuredLoggerWithOptions returns the structured logger middleware configured
+// with StructuredLoggerOptions
+func NewStructuredLoggerWithOptions(logger *logrus.Logger, options StructuredLoggerOptions) func(next http.Handler) http.Handler {
+	if options.Format == LogFormatCombined {
+		// combined lines bypass logrus and its lock, so both have to share the output's one
+		if _, ok := logger.Out.(*syncWriter); !ok {
+			logger.SetOutput(&syncWriter{out: logger.Out})
+		}
+	}
+	return middleware.RequestLogger(&StructuredLogger{
+		Logger:             logger,
+		ExtraFields:        options.ExtraFields,
+		ExtraFieldFuncs:    options.ExtraFieldFuncs,
+		CompletionFuncs:    options.CompletionFieldFuncs,
+		RequestHeaders:     options.RequestHeaders,
+		SkipPaths:          options.SkipPaths,
+		OmitPanicStack:     options.OmitPanicStack,
+		TimestampField:     options.TimestampField,
+		TimestampFormat:    options.TimestampFormat,
+		Format:             options.Format,
+		SampleRate:         options.SampleRate,
+		OmitRequestStarted: options.OmitRequestStarted,
+	})
+}
+
 // StructuredLogger implements custom structured middleware logger
 type StructuredLogger struct {
-	Logger          *logrus.Logger
-	ExtraFields     logrus.Fields
-	ExtraFieldFuncs LogrusFieldFuncs
+	// requests counts requests for sampling; it's first to be 64-bit aligned for atomic access
+	requests           uint64
+	Logger             *logrus.Logger
+	ExtraFields        logrus.Fields
+	ExtraFieldFuncs    LogrusFieldFuncs
+	CompletionFuncs    LogrusCompletionFieldFuncs
+	RequestHeaders     []string
+	SkipPaths          []string
+	OmitPanicStack     bool
+	TimestampField     string
+	TimestampFormat    string
+	Format             LogFormat
+	SampleRate         int
+	OmitRequestStarted bool
 }
 
 // NewLogEntry creates new log entry using information from the http.Request
 func (l *StructuredLogger) NewLogEntry(r *http.Request) middleware.LogEntry {
-	entry := &StructuredLoggerEntry{Logger: logrus.NewEntry(l.Logger)}
-	var logFields logrus.Fields
-	if l.ExtraFields != nil {
-		logFields = l.ExtraFields
-	} else {
-		logFields = logrus.Fields{}
+	entry := &StructuredLoggerEntry{
+		Logger:       logrus.NewEntry(l.Logger),
+		debug:        l.skipped(r),
+		omitStack:    l.OmitPanicStack,
+		routeContext: chi.RouteContext(r.Context()),
+		sampled:      l.sample(),
+	}
+	if l.Format == LogFormatCombined {
+		entry.combined = &combinedLogRequest{start: time.Now(), request: r, out: l.Logger}
+	}
+	if len(l.CompletionFuncs) > 0 {
+		entry.request = r
+		entry.completionFuncs = l.CompletionFuncs
+	}
+	// ExtraFields are shared by all requests, so per-request fields go to a copy
+	logFields := make(logrus.Fields, len(l.ExtraFields)+len(l.ExtraFieldFuncs)+16)
+	for key, value := range l.ExtraFields {
+		logFields[key] = value
 	}
 
 	// add logfields coming from function calls
@@ -50,11 +179,33 @@ func (l *StructuredLogger) NewLogEntry(r *http.Request) middleware.LogEntry {
 		logFields[key] = fun(r)
 	}
 
-	logFields["ts"] = time.Now().UTC().Format(time.RFC1123)
+	for _, name := range l.RequestHeaders {
+		value := r.Header.Get(name)
+		if value == "" {
+			continue
+		}
+		if sensitiveHeaders[http.CanonicalHeaderKey(name)] {
+			value = RedactedHeaderValue
+		}
+		logFields[headerFieldName(name)] = value
+	}
+
+	timestampField, timestampFormat := l.TimestampField, l.TimestampFormat
+	if timestampField == "" {
+		timestampField = DefaultTimestampField
+	}
+	if timestampFormat == "" {
+		timestampFormat = DefaultTimestampFormat
+	}
+	logFields[timestampField] = time.Now().UTC().Format(timestampFormat)
 
 	if reqID := middleware.GetReqID(r.Context()); reqID != "" {
 		logFields["req_id"] = reqID
 	}
+	if spanContext := trace.SpanContextFromContext(r.Context()); spanContext.IsValid() {
+		logFields["trace_id"] = spanContext.TraceID().String()
+		logFields["span_id"] = spanContext.SpanID().String()
+	}
 
 	scheme := "http"
 	if r.TLS != nil {
@@ -63,6 +214,9 @@ func (l *StructuredLogger) NewLogEntry(r *http.Request) middleware.LogEntry {
 	logFields["http_scheme"] = scheme
 	logFields["http_proto"] = r.Proto
 	logFields["http_method"] = r.Method
+	if protocol := RPCProtocol(r); protocol != "" {
+		logFields["rpc_protocol"] = protocol
+	}
 
 	logFields["remote_addr"] = r.RemoteAddr
 	logFields["user_agent"] = r.UserAgent()
@@ -71,32 +225,223 @@ func (l *StructuredLogger) NewLogEntry(r *http.Request) middleware.LogEntry {
 
 	entry.Logger = entry.Logger.WithFields(logFields)
 
-	entry.Logger.Infoln("request started")
+	if entry.combined == nil && entry.sampled && !l.OmitRequestStarted {
+		entry.log("request started")
+	}
 
 	return entry
 }
 
+// sample decides if the request is logged regardless of its outcome
+func (l *StructuredLogger) sample() bool {
+	if l.SampleRate <= 1 {
+		return true
+	}
+	return (atomic.AddUint64(&l.requests, 1)-1)%uint64(l.SampleRate) == 0
+}
+
+// skipped checks if the request's path is in SkipPaths
+func (l *StructuredLogger) skipped(r *http.Request) bool {
+	for _, path := range l.SkipPaths {
+		if strings.HasSuffix(path, "*") {
+			if strings.HasPrefix(r.URL.Path, strings.TrimSuffix(path, "*")) {
+				return true
+			}
+		} else if r.URL.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// headerFieldName returns the log field name for a header, e.g. "header_x_tenant" for "X-Tenant"
+func headerFieldName(name string) string {
+	return "header_" + strings.Replace(strings.ToLower(name), "-", "_", -1)
+}
+
 // StructuredLoggerEntry implements single structured log entry
 type StructuredLoggerEntry struct {
 	Logger logrus.FieldLogger
+	// debug is set for requests, which are logged only at debug level
+	debug bool
+	// panicked is set when the handler panicked
+	panicked bool
+	// omitStack leaves the stack trace out of panic logs
+	omitStack bool
+	// sampled is set for requests logged regardless of their outcome; the others are
+	// logged only on errors
+	sampled bool
+	// routeContext is filled in by chi during routing, so it has the route pattern in Write()
+	routeContext *chi.Context
+	// request and completionFuncs are set only when completion field funcs are configured
+	request         *http.Request
+	completionFuncs LogrusCompletionFieldFuncs
+	// combined is set when requests are logged in the combined log format
+	combined *combinedLogRequest
+}
+
+// combinedLogRequest holds the request details logged in the combined log format
+type combinedLogRequest struct {
+	start   time.Time
+	request *http.Request
+	out     *logrus.Logger
+}
+
+// write logs the request completion line in the NCSA combined log format:
+// remote - user [time] "METHOD uri proto" status bytes "referer" "user agent"
+func (c *combinedLogRequest) write(status, bytes int) {
+	r := c.request
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	user := "-"
+	if name, _, ok := r.BasicAuth(); ok && name != "" {
+		user = name
+	}
+	size := "-"
+	if bytes > 0 {
+		size = fmt.Sprintf("%d", bytes)
+	}
+	line := fmt.Sprintf("%s - %s [%s] %s %d %s %s %s\n", host, user, c.start.Format(combinedLogTimeFormat),
+		combinedLogQuote(fmt.Sprintf("%s %s %s", r.Method, r.RequestURI, r.Proto)), status, size,
+		combinedLogQuote(r.Referer()), combinedLogQuote(r.UserAgent()))
+	c.out.Out.Write([]byte(line))
+}
+
+// syncWriter serializes writes to the output shared by logrus and combined log lines
+type syncWriter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.out.Write(p)
+}
+
+// combinedLogQuote quotes the value for the combined log format, escaping quotes,
+// backslashes and control characters; empty values are logged as "-"
+func combinedLogQuote(value string) string {
+	if value == "" {
+		return `"-"`
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// log writes the message at info level, or debug level for skipped requests
+func (l *StructuredLoggerEntry) log(msg string) {
+	l.logAt(logrus.InfoLevel, msg)
+}
+
+// logAt writes the message at the level; info level messages of skipped requests are
+// written at debug level
+func (l *StructuredLoggerEntry) logAt(level logrus.Level, msg string) {
+	if l.debug && level == logrus.InfoLevel {
+		level = logrus.DebugLevel
+	}
+	switch level {
+	case logrus.ErrorLevel:
+		l.Logger.Errorln(msg)
+	case logrus.WarnLevel:
+		l.Logger.Warnln(msg)
+	case logrus.DebugLevel:
+		l.Logger.Debugln(msg)
+	default:
+		l.Logger.Infoln(msg)
+	}
+}
+
+// completionLevel returns the level of the request completion log message: error for
+// panics, warning for 5xx responses and info for all the others
+func (l *StructuredLoggerEntry) completionLevel(status int) logrus.Level {
+	switch {
+	case l.panicked:
+		return logrus.ErrorLevel
+	case status >= 500:
+		return logrus.WarnLevel
+	}
+	return logrus.InfoLevel
 }
 
 // Write writes end-of-request log message
 func (l *StructuredLoggerEntry) Write(status, bytes int, header http.Header, elapsed time.Duration, iface interface{}) {
+	if status == 0 {
+		// nothing was written, so net/http sends 200
+		status = http.StatusOK
+	}
+	if !l.sampled && !l.panicked && status < 400 {
+		return
+	}
+	if l.combined != nil {
+		l.writeCombined(status, bytes)
+		return
+	}
 	l.Logger = l.Logger.WithFields(logrus.Fields{
 		"resp_status": status, "resp_bytes_length": bytes,
-		"resp_elapsed_ms": float64(elapsed.Nanoseconds()) / 1000000.0,
+		"resp_status_text": http.StatusText(status),
+		"status_class":     fmt.Sprintf("%dxx", status/100),
+		"resp_elapsed_ms":  float64(elapsed.Nanoseconds()) / 1000000.0,
 	})
+	if l.routeContext != nil {
+		if pattern := l.routeContext.RoutePattern(); pattern != "" {
+			l.Logger = l.Logger.WithField("route", pattern)
+		}
+	}
+	// gRPC status is sent in headers for trailers-only responses, otherwise in trailers
+	grpcStatus := header.Get("Grpc-Status")
+	if grpcStatus == "" {
+		grpcStatus = header.Get(http.TrailerPrefix + "Grpc-Status")
+	}
+	if grpcStatus != "" {
+		l.Logger = l.Logger.WithField("grpc_status", grpcStatus)
+	}
+	if len(l.completionFuncs) > 0 {
+		fields := make(logrus.Fields, len(l.completionFuncs))
+		for key, fun := range l.completionFuncs {
+			fields[key] = fun(l.request, status, bytes, header)
+		}
+		l.Logger = l.Logger.WithFields(fields)
+	}
 
-	l.Logger.Infoln("request complete")
+	l.logAt(l.completionLevel(status), "request complete")
 }
 
-// Panic logs a panic
+// writeCombined logs the request in the combined log format; skipped requests are logged
+// only at debug level, and panics are additionally logged as logrus entries with the details
+func (l *StructuredLoggerEntry) writeCombined(status, bytes int) {
+	if l.panicked {
+		l.Logger.WithField("resp_status", status).Errorln("request panicked")
+	}
+	if l.debug && !l.combined.out.IsLevelEnabled(logrus.DebugLevel) {
+		return
+	}
+	l.combined.write(status, bytes)
+}
+
+// Panic adds the panic details to the entry; the request is then logged at error level
 func (l *StructuredLoggerEntry) Panic(v interface{}, stack []byte) {
-	l.Logger = l.Logger.WithFields(logrus.Fields{
-		"stack": string(stack),
-		"panic": fmt.Sprintf("%+v", v),
-	})
+	l.panicked = true
+	fields := logrus.Fields{"panic": fmt.Sprintf("%+v", v)}
+	if !l.omitStack {
+		fields["stack"] = string(stack)
+	}
+	l.Logger = l.Logger.WithFields(fields)
 }
 
 // Helper methods used by the application to get the request-scoped
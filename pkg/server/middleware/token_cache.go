@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// tokenCache is a bounded LRU cache of successfully validated JWT tokens, keyed by the
+// full raw token string. Entries are never returned after the token's expiry time.
+type tokenCache struct {
+	lock  sync.Mutex
+	size  int
+	items map[string]*list.Element
+	lru   *list.List
+}
+
+type tokenCacheEntry struct {
+	rawToken  string
+	token     *jwt.Token
+	expiresAt time.Time
+}
+
+func newTokenCache(size int) *tokenCache {
+	return &tokenCache{
+		size:  size,
+		items: make(map[string]*list.Element, size),
+		lru:   list.New(),
+	}
+}
+
+// get returns the cached token if it's present and not yet expired at now
+func (c *tokenCache) get(rawToken string, now time.Time) (*jwt.Token, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, found := c.items[rawToken]
+	if !found {
+		return nil, false
+	}
+	entry := elem.Value.(*tokenCacheEntry)
+	if !now.Before(entry.expiresAt) {
+		c.lru.Remove(elem)
+		delete(c.items, rawToken)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.token, true
+}
+
+// add caches a validated token until its expiry time, evicting the least recently used
+// entry if the cache is full. Tokens without an 'exp' claim are never cached.
+func (c *tokenCache) add(token *jwt.Token) {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return
+	}
+	expiresAt, ok := claimTime(claims, "exp")
+	if !ok {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, found := c.items[token.Raw]; found {
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.items[token.Raw] = c.lru.PushFront(&tokenCacheEntry{
+		rawToken:  token.Raw,
+		token:     token,
+		expiresAt: expiresAt,
+	})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.items, oldest.Value.(*tokenCacheEntry).rawToken)
+	}
+}
+
+// claimTime returns the value of a numeric date claim as time.Time
+func claimTime(claims jwt.MapClaims, name string) (time.Time, bool) {
+	switch value := claims[name].(type) {
+	case float64:
+		return time.Unix(int64(value), 0), true
+	case json.Number:
+		v, err := value.Int64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(v, 0), true
+	}
+	return time.Time{}, false
+}
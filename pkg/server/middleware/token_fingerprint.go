@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	jwtmiddleware "github.com/auth0/go-jwt-middleware"
+)
+
+// tokenFingerprintBytes is the number of SHA-256 bytes kept in a token fingerprint
+const tokenFingerprintBytes = 8
+
+// TokenFingerprint returns a short, non-reversible fingerprint of the bearer token
+// used by the request. It's safe to log and allows to correlate requests made with the
+// same token without exposing the token itself. Empty string is returned if the request
+// carries no token.
+func TokenFingerprint(r *http.Request) string {
+	raw := ""
+	if token, ok := GetToken(r); ok {
+		raw = token.Raw
+	} else if fromHeader, err := jwtmiddleware.FromAuthHeader(r); err == nil {
+		raw = fromHeader
+	}
+	if raw == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:tokenFingerprintBytes])
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// DefaultIntrospectionCacheSize is the number of active tokens cached by the JwtAuthenticator
+// validating tokens with introspection, unless TokenCacheSize is set
+const DefaultIntrospectionCacheSize = 1000
+
+// maxIntrospectionResponseBytes limits the size of introspection responses read
+const maxIntrospectionResponseBytes = 1 << 20
+
+// tokenIntrospector validates opaque tokens with the introspection endpoint of the
+// provider, as described in RFC 7662
+type tokenIntrospector struct {
+	url          string
+	clientID     string
+	clientSecret string
+	userAgent    string
+	client       *http.Client
+}
+
+// introspect POSTs the token to the introspection endpoint and returns the claims of the
+// introspection response if the token is active. The client authenticates with HTTP Basic
+// auth. Network failures and unexpected responses are returned as AuthReasonIntrospectionFailed.
+func (i *tokenIntrospector) introspect(ctx context.Context, rawToken string) (jwt.MapClaims, *AuthError) {
+	form := url.Values{"token": {rawToken}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest(http.MethodPost, i.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, &AuthError{Reason: AuthReasonIntrospectionFailed, Err: err}
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", i.userAgent)
+	if i.clientID != "" {
+		// RFC 6749, section 2.3.1 requires the credentials to be form encoded first
+		req.SetBasicAuth(url.QueryEscape(i.clientID), url.QueryEscape(i.clientSecret))
+	}
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, &AuthError{Reason: AuthReasonIntrospectionFailed, Err: fmt.Errorf("can't introspect token: %v", err)}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxIntrospectionResponseBytes))
+		return nil, &AuthError{Reason: AuthReasonIntrospectionFailed,
+			Err: fmt.Errorf("can't introspect token: unexpected status %d", resp.StatusCode)}
+	}
+	var claims jwt.MapClaims
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxIntrospectionResponseBytes)).Decode(&claims); err != nil {
+		return nil, &AuthError{Reason: AuthReasonIntrospectionFailed, Err: fmt.Errorf("can't parse introspection response: %v", err)}
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, newAuthError(AuthReasonInactive, "Token is not active")
+	}
+	return claims, nil
+}
@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the OpenTelemetry tracer used by the tracing middleware
+const tracerName = modulePath + "/pkg/server/middleware"
+
+// NewTracing returns a middleware, which wraps every request in an OpenTelemetry server
+// span created with the tracerProvider. Incoming W3C 'traceparent' headers are used as
+// the parent of the span. The span is named after the matched chi route pattern and
+// records the response status code. It has to be used before the structured logger
+// to get 'trace_id' and 'span_id' fields in request logs.
+func NewTracing(tracerProvider trace.TracerProvider) func(next http.Handler) http.Handler {
+	tracer := tracerProvider.Tracer(tracerName)
+	propagator := propagation.TraceContext{}
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer.Start(ctx, "HTTP "+r.Method,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest("", "", r)...))
+			defer span.End()
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			r = r.WithContext(ctx)
+			next.ServeHTTP(ww, r)
+
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				span.SetName(rctx.RoutePattern())
+				span.SetAttributes(semconv.HTTPRouteKey.String(rctx.RoutePattern()))
+			}
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(status)...)
+			span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(status, trace.SpanKindServer))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+
+	"github.com/go-chi/render"
+)
+
+// NewUserAgentFilter returns a middleware, which rejects requests with an empty User-Agent
+// header or with one matching any of blockPatterns with a 400 response. If allowPatterns
+// is not empty, the User-Agent must also match at least one of them.
+func NewUserAgentFilter(allowPatterns, blockPatterns []*regexp.Regexp) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			userAgent := r.UserAgent()
+			if userAgent == "" {
+				render.Render(w, r, ErrInvalidRequest(errors.New("User-Agent header is required")))
+				return
+			}
+			for _, pattern := range blockPatterns {
+				if pattern.MatchString(userAgent) {
+					render.Render(w, r, ErrInvalidRequest(errors.New("User-Agent is not allowed")))
+					return
+				}
+			}
+			if len(allowPatterns) > 0 {
+				allowed := false
+				for _, pattern := range allowPatterns {
+					if pattern.MatchString(userAgent) {
+						allowed = true
+						break
+					}
+				}
+				if !allowed {
+					render.Render(w, r, ErrInvalidRequest(errors.New("User-Agent is not allowed")))
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
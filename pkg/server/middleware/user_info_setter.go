@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/render"
+	"github.com/golang-jwt/jwt"
+)
+
+// NewUserInfoSetter returns a middleware, which sets the user name, roles and admin flag
+// of requests authenticated with a JWT token under CtxUserKey, CtxRolesKey and CtxIsAdminKey.
+// The user is read from userClaim (DefaultUserClaim if empty) and requests without it
+// are rejected. Roles are read from rolesClaim (DefaultRolesClaim if empty), which can be
+// a dotted path to a nested claim, like "realm_access.roles", and can hold a single
+// string or an array; tokens without it get no roles. The admin flag is set when roles
+// include adminRole (AdminUserRole if empty).
+func NewUserInfoSetter(userClaim, rolesClaim, adminRole string) func(http.Handler) http.Handler {
+	if userClaim == "" {
+		userClaim = DefaultUserClaim
+	}
+	if rolesClaim == "" {
+		rolesClaim = DefaultRolesClaim
+	}
+	if adminRole == "" {
+		adminRole = AdminUserRole
+	}
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			token, ok := GetToken(r)
+			// if there's no JWT token, this is a public path
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			claims, ok := token.Claims.(jwt.MapClaims)
+			if !ok || claims == nil {
+				render.Render(w, r, ErrAuth(errors.New("claims not found in auth token in Context()")))
+				return
+			}
+
+			user, ok := lookupClaim(claims, userClaim)
+			userName, isString := user.(string)
+			if !ok || !isString || userName == "" {
+				render.Render(w, r, ErrAuth(fmt.Errorf("%s claim not found in claims", userClaim)))
+				return
+			}
+			var roles []string
+			if value, found := lookupClaim(claims, rolesClaim); found {
+				var err error
+				if roles, err = claimStrings(value); err != nil {
+					render.Render(w, r, ErrAuth(fmt.Errorf("invalid %s claim: %v", rolesClaim, err)))
+					return
+				}
+			}
+			isAdmin := false
+			for _, role := range roles {
+				if role == adminRole {
+					isAdmin = true
+					break
+				}
+			}
+
+			ctx := context.WithValue(r.Context(), CtxUserKey, userName)
+			ctx = context.WithValue(ctx, CtxRolesKey, roles)
+			ctx = context.WithValue(ctx, CtxIsAdminKey, isAdmin)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// lookupClaim returns the claim under path. A claim named exactly like path is preferred,
+// as namespaced claim names often contain dots; otherwise path is split on dots and followed
+// through nested objects.
+func lookupClaim(claims map[string]interface{}, path string) (interface{}, bool) {
+	if value, found := claims[path]; found {
+		return value, true
+	}
+	segments := strings.Split(path, ".")
+	var value interface{} = claims
+	for _, segment := range segments {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[segment]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// claimStrings converts a claim holding a single string or an array of strings to a slice
+func claimStrings(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case string:
+		return []string{v}, nil
+	case []string:
+		return v, nil
+	case []interface{}:
+		result := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected an array of strings, got element %v", item)
+			}
+			result = append(result, s)
+		}
+		return result, nil
+	default:
+		return nil, fmt.Errorf("expected a string or an array of strings, got %v", value)
+	}
+}
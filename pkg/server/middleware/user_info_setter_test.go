@@ -0,0 +1,104 @@
+package middleware_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/piontec/go-chi-middleware-server/pkg/server/middleware"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserInfoSetter(t *testing.T) {
+	type userInfo struct {
+		user    interface{}
+		roles   interface{}
+		isAdmin interface{}
+	}
+	serve := func(rolesClaim string, claims jwt.MapClaims) (int, userInfo) {
+		var info userInfo
+		handler := middleware.NewUserInfoSetter("", rolesClaim, "")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			info = userInfo{
+				user:    r.Context().Value(middleware.CtxUserKey),
+				roles:   r.Context().Value(middleware.CtxRolesKey),
+				isAdmin: r.Context().Value(middleware.CtxIsAdminKey),
+			}
+			user, userOK := middleware.GetUser(r)
+			roles, rolesOK := middleware.GetRoles(r)
+			assert.Equal(t, info.user != nil, userOK)
+			assert.Equal(t, info.roles != nil, rolesOK)
+			if userOK {
+				assert.Equal(t, info.user, user)
+				assert.Equal(t, info.roles, roles)
+				assert.Equal(t, info.isAdmin, middleware.IsAdmin(r))
+			}
+		}))
+		req := httptest.NewRequest("GET", "/", nil)
+		if claims != nil {
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+			req = req.WithContext(context.WithValue(req.Context(), middleware.CtxJWTKey, token))
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code, info
+	}
+
+	code, info := serve("", jwt.MapClaims{"sub": "alice", "roles": []interface{}{"reader", "admin"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, userInfo{"alice", []string{"reader", "admin"}, true}, info)
+
+	code, info = serve("", jwt.MapClaims{"sub": "bob", "roles": "reader"})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, userInfo{"bob", []string{"reader"}, false}, info)
+
+	code, info = serve("realm_access.roles", jwt.MapClaims{
+		"sub":          "carol",
+		"realm_access": map[string]interface{}{"roles": []interface{}{"admin"}},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, userInfo{"carol", []string{"admin"}, true}, info)
+
+	code, info = serve("https://example.com/roles", jwt.MapClaims{"sub": "dave", "https://example.com/roles": []interface{}{"admin"}})
+	assert.Equal(t, http.StatusOK, code, "claim names with dots must be found")
+	assert.Equal(t, userInfo{"dave", []string{"admin"}, true}, info)
+
+	code, info = serve("", jwt.MapClaims{"sub": "erin"})
+	assert.Equal(t, http.StatusOK, code, "tokens without roles are accepted")
+	assert.Equal(t, userInfo{"erin", []string(nil), false}, info)
+
+	code, _ = serve("", jwt.MapClaims{"sub": "frank", "roles": []interface{}{"reader", 1}})
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, _ = serve("", jwt.MapClaims{"roles": "admin"})
+	assert.Equal(t, http.StatusUnauthorized, code, "tokens without the user claim are rejected")
+
+	code, info = serve("", nil)
+	assert.Equal(t, http.StatusOK, code, "requests without a token are passed through")
+	assert.Equal(t, userInfo{}, info)
+}
+
+func TestRequireAdmin(t *testing.T) {
+	handler := middleware.NewRequireAdmin()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	serve := func(ctx context.Context) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("DELETE", "/items/1", nil).WithContext(ctx))
+		return rec
+	}
+
+	assert.Equal(t, http.StatusNoContent, serve(context.WithValue(context.Background(), middleware.CtxIsAdminKey, true)).Code)
+	for _, ctx := range []context.Context{
+		context.Background(),
+		context.WithValue(context.Background(), middleware.CtxIsAdminKey, false),
+		context.WithValue(context.Background(), "is_admin", true),
+	} {
+		rec := serve(ctx)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.Equal(t, "application/json; charset=utf-8", rec.Header().Get("Content-Type"))
+		assert.JSONEq(t, `{"status":"Forbidden.","error":"admin role is required"}`, rec.Body.String())
+	}
+}
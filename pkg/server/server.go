@@ -2,18 +2,28 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"strconv"
+	"sync"
 	"time"
 
-	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/cors"
 	"github.com/go-chi/docgen"
-	"github.com/go-chi/render"
+	"github.com/golang-jwt/jwt"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	msm "github.com/piontec/go-chi-middleware-server/pkg/server/middleware"
 )
@@ -21,58 +31,271 @@ import (
 const (
 	defaultHTTPPort                = 8080
 	defaultGracefulShutdownTimeSec = 30
+	defaultAdminBindAddress        = "127.0.0.1"
+	defaultReadHeaderTimeout       = 10 * time.Second
+	defaultReadTimeout             = 60 * time.Second
+	defaultWriteTimeout            = 60 * time.Second
+	defaultIdleTimeout             = 120 * time.Second
 )
 
 // ChiServerOptions allows to override default ChiServer options
 type ChiServerOptions struct {
 	HTTPPort                int
+	BindAddress             string
+	UnixSocketPath          string
+	EnableH2C               bool
+	Logger                  *logrus.Logger
 	LoggerFields            logrus.Fields
+	LogFormatter            logrus.Formatter
+	LogOutput               io.Writer
+	LogFormat               msm.LogFormat
+	LogSampleRate           int
+	LogOmitRequestStarted   bool
 	LoggerFieldFuncs        msm.LogrusFieldFuncs
+	LoggerCompletionFuncs   msm.LogrusCompletionFieldFuncs
+	LogRequestHeaders       []string
+	LogSkipPaths            []string
+	LogBodies               bool
+	LogBodyMaxBytes         int
+	LogOmitPanicStack       bool
+	LogTimestampField       string
+	LogTimestampFormat      string
+	ContextHeaders          []string
 	GracefulShutdownTimeSec int
+	OnShutdown              func(context.Context) error
+	RequestTimeout          time.Duration
+	DeadlineHeader          string
+	ReadHeaderTimeout       time.Duration
+	ReadTimeout             time.Duration
+	WriteTimeout            time.Duration
+	IdleTimeout             time.Duration
+	DisableDefaultTimeouts  bool
+	EnableMetrics           bool
+	TracerProvider          trace.TracerProvider
+	MetricsPath             string
+	AdminPort               int
+	AdminBindAddress        string
+	AdminRoutes             func(r chi.Router)
+	AdminOpsEndpoints       bool
 	DisableOIDCMiddleware   bool
 	DisableRequestID        bool
+	RequestIDHeader         string
 	DisableRealIP           bool
+	TrustedProxies          []string
+	DisableRecoverer        bool
 	DisableHeartbeat        bool
+	HeartbeatPath           string
+	HeartbeatBody           string
+	ReadinessChecks         msm.ReadinessChecks
 	DisableURLFormat        bool
+	ReadOnlyMode            bool
+	EnableMethodOverride    bool
+	RateLimitOptions        *ChiRateLimitOptions
+	MaxRequestBodyBytes     int64
+	QueryLimitsOptions      *ChiQueryLimitsOptions
+	UserAgentFilterOptions  *ChiUserAgentFilterOptions
+	RootOptions             *ChiRootOptions
+	CORSOptions             *ChiCORSOptions
+	SecurityHeadersOptions  *ChiSecurityHeadersOptions
 	OIDCOptions             ChiOIDCMiddlewareOptions
 	ContextSetterOptions    ChiContextSetterOptions
+	UserInfoOptions         *ChiUserInfoOptions
+	BasicAuthOptions        *ChiBasicAuthOptions
+	APIKeyAuthOptions       *ChiAPIKeyAuthOptions
+}
+
+// ChiSecurityHeadersOptions configures the SecurityHeaders Middleware
+type ChiSecurityHeadersOptions struct {
+	ContentTypeOptions      string
+	FrameOptions            string
+	ReferrerPolicy          string
+	StrictTransportSecurity string
+	AlwaysSendHSTS          bool
+	ContentSecurityPolicy   string
+	OmitHeaders             []string
+}
+
+// ChiBasicAuthOptions configures the BasicAuth Middleware, which runs before the OIDC one
+type ChiBasicAuthOptions struct {
+	Users       map[string]string
+	URLPrefixes []string
+	AllowBearer bool
+	Realm       string
+}
+
+// ChiAPIKeyAuthOptions configures the APIKeyAuth Middleware, which runs before the OIDC one
+type ChiAPIKeyAuthOptions struct {
+	Header      string
+	Keys        map[string]string
+	URLPrefixes []string
+	AllowBearer bool
 }
 
 // ChiOIDCMiddlewareOptions configures OIDC Middleware
 type ChiOIDCMiddlewareOptions struct {
-	Audience           string
-	Issuer             string
-	JwksURL            string
-	PublicURLsPrefixes []string
+	Audience              string
+	Audiences             []string
+	SkipAudienceCheck     bool
+	AllowMissingAudience  bool
+	Issuer                string
+	AllowMissingIssuer    bool
+	JwksURL               string
+	JwksFile              string
+	JwksInline            string
+	PublicURLsPrefixes    []string
+	PublicURLsPatterns    []string
+	PublicURLs            []msm.PublicURL
+	JwksRefreshInterval   time.Duration
+	ClockSkew             time.Duration
+	TokenCacheSize        int
+	LogAuthLatency        bool
+	JwksUserAgent         string
+	JwksRequestHeaders    map[string]string
+	JwksHTTPClient        *http.Client
+	AllowedTokenTypes     []string
+	AllowMissingTokenType bool
+	ClaimValidators       []func(jwt.MapClaims) error
+	IntrospectionURL      string
+	ClientID              string
+	ClientSecret          string
+}
+
+// ChiUserAgentFilterOptions configures the UserAgentFilter Middleware; patterns are regular expressions
+type ChiUserAgentFilterOptions struct {
+	AllowPatterns []string
+	BlockPatterns []string
+}
+
+// ChiRootOptions configures the built-in response for the root path `/`; if RedirectURL
+// is set, requests are redirected there, otherwise Info is returned as JSON
+type ChiRootOptions struct {
+	RedirectURL string
+	Info        map[string]interface{}
+}
+
+// ChiCORSOptions configures the CORS Middleware
+type ChiCORSOptions struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           int
+}
+
+// ChiRateLimitOptions configures the RateLimiter Middleware. Requests are limited by the
+// client's IP, unless KeyFunc is set; the middleware with a custom KeyFunc runs after
+// authentication, so it can key requests e.g. by the subject of the token in Context().
+type ChiRateLimitOptions struct {
+	Requests int
+	Interval time.Duration
+	Burst    int
+	KeyFunc  msm.RateLimitKeyFunc
+}
+
+// ChiQueryLimitsOptions configures the QueryLimits Middleware; zero values use defaults
+type ChiQueryLimitsOptions struct {
+	MaxParams      int
+	MaxValueLength int
 }
 
 // ChiContextSetterOptions configures the ContextSetter Middleware
 type ChiContextSetterOptions struct {
 	ClaimToContextKeyMapping map[string]interface{}
+	SkipMissingClaims        bool
+	OptionalClaims           []string
+	OmitUserLogField         bool
 }
 
-func (o *ChiServerOptions) fillDefaults(logger *logrus.Logger) {
+// ChiUserInfoOptions configures the UserInfoSetter Middleware
+type ChiUserInfoOptions struct {
+	UserClaim  string
+	RolesClaim string
+	AdminRole  string
+}
+
+// fillDefaults sets defaults of the options which weren't set and validates the configuration
+func (o *ChiServerOptions) fillDefaults() error {
 	if o.HTTPPort == 0 {
 		o.HTTPPort = defaultHTTPPort
 	}
 	if o.GracefulShutdownTimeSec == 0 {
 		o.GracefulShutdownTimeSec = defaultGracefulShutdownTimeSec
 	}
+	if !o.DisableDefaultTimeouts {
+		if o.ReadHeaderTimeout == 0 {
+			o.ReadHeaderTimeout = defaultReadHeaderTimeout
+		}
+		if o.ReadTimeout == 0 {
+			o.ReadTimeout = defaultReadTimeout
+		}
+		if o.WriteTimeout == 0 {
+			o.WriteTimeout = defaultWriteTimeout
+		}
+		if o.IdleTimeout == 0 {
+			o.IdleTimeout = defaultIdleTimeout
+		}
+	}
+	if o.EnableMetrics && o.MetricsPath == "" {
+		o.MetricsPath = msm.DefaultMetricsPath
+	}
+	if (o.AdminRoutes != nil || o.AdminOpsEndpoints) && o.AdminPort == 0 {
+		return errors.New("admin routes or ops endpoints are configured, but no AdminPort was provided")
+	}
+	if o.AdminBindAddress == "" {
+		o.AdminBindAddress = defaultAdminBindAddress
+	}
 	if o.DisableOIDCMiddleware == false && (o.OIDCOptions.Issuer == "" ||
-		o.OIDCOptions.Audience == "") {
-		logger.Panicf("OIDC middleware is enabled in server configuration, but no valid configuration was provided.")
+		(o.OIDCOptions.Audience == "" && len(o.OIDCOptions.Audiences) == 0 && !o.OIDCOptions.SkipAudienceCheck)) {
+		return errors.New("OIDC middleware is enabled in server configuration, but no valid configuration was provided")
+	}
+	if o.DisableOIDCMiddleware == false && o.OIDCOptions.JwksURL == "" && o.OIDCOptions.JwksFile == "" &&
+		o.OIDCOptions.JwksInline == "" && o.OIDCOptions.IntrospectionURL == "" {
+		return errors.New("OIDC middleware is enabled in server configuration, but no JwksURL, JwksFile, JwksInline or IntrospectionURL was provided")
+	}
+	if err := msm.CheckContextKeys(o.ContextSetterOptions.ClaimToContextKeyMapping); err != nil {
+		return fmt.Errorf("invalid ContextSetterOptions: %v", err)
 	}
+	if o.RateLimitOptions != nil {
+		if err := msm.CheckRateLimit(o.RateLimitOptions.Requests, o.RateLimitOptions.Interval,
+			o.RateLimitOptions.Burst); err != nil {
+			return fmt.Errorf("invalid RateLimitOptions: %v", err)
+		}
+	}
+	if o.BasicAuthOptions != nil {
+		if err := msm.CheckBasicAuthUsers(o.BasicAuthOptions.Users); err != nil {
+			return fmt.Errorf("invalid BasicAuthOptions: %v", err)
+		}
+	}
+	return nil
 }
 
+// serverState describes the lifecycle phase of ChiServer
+type serverState int
+
+const (
+	stateNew serverState = iota
+	stateRunning
+	stateStopping
+	stateStopped
+)
+
 // ChiServer is an opinionated HTTP server based on go-chi middleware
 type ChiServer struct {
-	options  *ChiServerOptions
-	logger   *logrus.Logger
-	mux      *chi.Mux
-	started  bool
-	listener net.Listener
-	stopChan chan interface{}
-	server   *http.Server
+	options     *ChiServerOptions
+	logger      *logrus.Logger
+	mux         *chi.Mux
+	stateLock   sync.Mutex
+	state       serverState
+	listener    net.Listener
+	stopped     chan struct{}
+	server      *http.Server
+	adminServer *http.Server
+	jwtAuth     *msm.JwtAuthenticator
+	metrics     *msm.Metrics
+	active      *msm.RequestCounter
+	hooksLock   sync.Mutex
+	hooks       []func(context.Context) error
 }
 
 // GetLogger returns a pointer to the logger used by the server
@@ -80,60 +303,405 @@ func (s *ChiServer) GetLogger() *logrus.Logger {
 	return s.logger
 }
 
-// NewChiServer returns a HTTP chi server optionally configured with ChiServerOptions
+// GetMetricsRegistry returns the Prometheus registry used by the server, so applications
+// can register their own metrics. It returns nil if metrics are not enabled.
+func (s *ChiServer) GetMetricsRegistry() *prometheus.Registry {
+	if s.metrics == nil {
+		return nil
+	}
+	return s.metrics.Registry()
+}
+
+// NewChiServer returns a HTTP chi server optionally configured with ChiServerOptions.
+// It panics if the configuration is invalid; use NewChiServerE to get an error instead.
 func NewChiServer(routesRegistrationHandler func(r *chi.Mux), options *ChiServerOptions) *ChiServer {
-	// initialize logrus as logger
-	logger := logrus.New()
-	logger.Formatter = &logrus.JSONFormatter{
-		DisableTimestamp: true,
+	s, logger, err := newChiServer(routesRegistrationHandler, options)
+	if err != nil {
+		logger.Panicf("Invalid server configuration: %v", err)
 	}
+	return s
+}
+
+// NewChiServerE returns a HTTP chi server optionally configured with ChiServerOptions, like
+// NewChiServer, but returns an error instead of panicking if the configuration is invalid
+func NewChiServerE(routesRegistrationHandler func(r *chi.Mux), options *ChiServerOptions) (*ChiServer, error) {
+	s, _, err := newChiServer(routesRegistrationHandler, options)
+	return s, err
+}
 
+// newChiServer creates the server; it returns the logger even when the configuration is invalid,
+// so the error can be logged with it
+func newChiServer(routesRegistrationHandler func(r *chi.Mux), options *ChiServerOptions) (*ChiServer, *logrus.Logger, error) {
 	// if we didn't get any options, initialize with default struct
 	if options == nil {
 		options = &ChiServerOptions{}
 	}
+
+	// initialize logrus as logger, unless the application provided its own, already
+	// configured one; only formatter and output set explicitly in options override its setup
+	logger := options.Logger
+	if logger == nil {
+		logger = logrus.New()
+		logger.Formatter = &logrus.JSONFormatter{
+			DisableTimestamp: true,
+		}
+	}
+	if options.LogFormatter != nil {
+		logger.Formatter = options.LogFormatter
+	}
+	if options.LogOutput != nil {
+		logger.Out = options.LogOutput
+	}
 	// initialize default options
-	options.fillDefaults(logger)
+	if err := options.fillDefaults(); err != nil {
+		return nil, logger, err
+	}
+	// parse the configured patterns and networks up front, so invalid ones are reported
+	// before the router is set up
+	trustedProxies, err := parseCIDRs(options.TrustedProxies)
+	if err != nil {
+		return nil, logger, err
+	}
+	publicURLPatterns, err := compilePatterns(options.OIDCOptions.PublicURLsPatterns)
+	if err != nil {
+		return nil, logger, err
+	}
+	var userAgentAllow, userAgentBlock []*regexp.Regexp
+	if options.UserAgentFilterOptions != nil {
+		if userAgentAllow, err = compilePatterns(options.UserAgentFilterOptions.AllowPatterns); err != nil {
+			return nil, logger, err
+		}
+		if userAgentBlock, err = compilePatterns(options.UserAgentFilterOptions.BlockPatterns); err != nil {
+			return nil, logger, err
+		}
+	}
 
 	r := chi.NewRouter()
+	activeRequests := &msm.RequestCounter{}
+	r.Use(activeRequests.GetHandler())
+	// tracing wraps the whole chain, so the span covers all the middleware and is logged
+	if options.TracerProvider != nil {
+		r.Use(msm.NewTracing(options.TracerProvider))
+	}
 	if !options.DisableRequestID {
 		r.Use(middleware.RequestID)
+		r.Use(msm.NewRequestIDHeader(options.RequestIDHeader))
 	}
 	if !options.DisableRealIP {
-		r.Use(middleware.RealIP)
+		if len(options.TrustedProxies) > 0 {
+			r.Use(msm.NewTrustedRealIP(trustedProxies))
+		} else {
+			r.Use(middleware.RealIP)
+		}
+	}
+	// set first, so also the responses of middleware rejecting requests get the headers
+	if options.SecurityHeadersOptions != nil {
+		r.Use(msm.NewSecurityHeadersWithOptions(msm.SecurityHeadersOptions{
+			ContentTypeOptions:      options.SecurityHeadersOptions.ContentTypeOptions,
+			FrameOptions:            options.SecurityHeadersOptions.FrameOptions,
+			ReferrerPolicy:          options.SecurityHeadersOptions.ReferrerPolicy,
+			StrictTransportSecurity: options.SecurityHeadersOptions.StrictTransportSecurity,
+			AlwaysSendHSTS:          options.SecurityHeadersOptions.AlwaysSendHSTS,
+			ContentSecurityPolicy:   options.SecurityHeadersOptions.ContentSecurityPolicy,
+			OmitHeaders:             options.SecurityHeadersOptions.OmitHeaders,
+		}))
+	}
+	r.Use(newStructuredLogger(logger, options))
+	if options.LogBodies {
+		r.Use(msm.NewBodyLogger(options.LogBodyMaxBytes))
+	}
+	var metrics *msm.Metrics
+	if options.EnableMetrics {
+		metrics = msm.NewMetrics()
+		if !options.AdminOpsEndpoints {
+			r.Use(msm.NewMetricsEndpoint(options.MetricsPath, metrics.Registry()))
+		}
+		r.Use(metrics.GetHandler())
+	}
+	if !options.DisableRecoverer {
+		r.Use(msm.NewRecoverer())
+	}
+	if options.RequestTimeout > 0 {
+		// handlers have to observe r.Context().Done() for the timeout to actually cancel their work
+		r.Use(middleware.Timeout(options.RequestTimeout))
+	}
+	if options.DeadlineHeader != "" {
+		r.Use(msm.NewDeadlineHeader(options.DeadlineHeader))
+	}
+	var rateLimiter *msm.RateLimiter
+	if options.RateLimitOptions != nil {
+		rateLimiter = msm.NewRateLimiter(options.RateLimitOptions.Requests, options.RateLimitOptions.Interval,
+			options.RateLimitOptions.Burst, options.RateLimitOptions.KeyFunc)
+		// limiting by IP happens as early as possible, custom keys may need authentication
+		if options.RateLimitOptions.KeyFunc == nil {
+			r.Use(rateLimiter.GetHandler())
+		}
+	}
+	// CORS has to be handled before authentication, so preflight requests don't require a token
+	if options.CORSOptions != nil {
+		r.Use(cors.Handler(cors.Options{
+			AllowedOrigins:   options.CORSOptions.AllowedOrigins,
+			AllowedMethods:   options.CORSOptions.AllowedMethods,
+			AllowedHeaders:   options.CORSOptions.AllowedHeaders,
+			ExposedHeaders:   options.CORSOptions.ExposedHeaders,
+			AllowCredentials: options.CORSOptions.AllowCredentials,
+			MaxAge:           options.CORSOptions.MaxAge,
+		}))
+	}
+	if options.MaxRequestBodyBytes > 0 {
+		r.Use(msm.NewMaxBodySize(options.MaxRequestBodyBytes))
+	}
+	if options.QueryLimitsOptions != nil {
+		r.Use(msm.NewQueryLimits(options.QueryLimitsOptions.MaxParams, options.QueryLimitsOptions.MaxValueLength))
+	}
+	if options.EnableMethodOverride {
+		r.Use(msm.NewMethodOverride())
+	}
+	if len(options.ContextHeaders) > 0 {
+		r.Use(msm.NewHeaderContext(options.ContextHeaders))
 	}
-	r.Use(msm.NewStructuredLogger(logger, options.LoggerFields, options.LoggerFieldFuncs))
-	r.Use(middleware.Recoverer)
 	if !options.DisableHeartbeat {
-		r.Use(middleware.Heartbeat("/ping"))
+		r.Use(msm.NewHeartbeat(options.HeartbeatPath, options.HeartbeatBody))
+		if !options.AdminOpsEndpoints {
+			r.Use(msm.NewHealthChecks(options.ReadinessChecks))
+		}
+	}
+	if options.RootOptions != nil {
+		r.Use(msm.NewRootHandler(options.RootOptions.RedirectURL, options.RootOptions.Info))
+	}
+	if options.UserAgentFilterOptions != nil {
+		r.Use(msm.NewUserAgentFilter(userAgentAllow, userAgentBlock))
+	}
+	if options.ReadOnlyMode {
+		r.Use(msm.NewReadOnlyGuard())
 	}
 	if !options.DisableURLFormat {
 		r.Use(middleware.URLFormat)
 	}
-	r.Use(render.SetContentType(render.ContentTypeJSON))
+	r.Use(msm.NewJSONContentType())
+	if options.BasicAuthOptions != nil {
+		r.Use(msm.NewBasicAuthWithOptions(msm.BasicAuthOptions{
+			Users:       options.BasicAuthOptions.Users,
+			URLPrefixes: options.BasicAuthOptions.URLPrefixes,
+			AllowBearer: options.BasicAuthOptions.AllowBearer,
+			Realm:       options.BasicAuthOptions.Realm,
+		}))
+	}
+	if options.APIKeyAuthOptions != nil {
+		r.Use(msm.NewAPIKeyAuthWithOptions(msm.APIKeyAuthOptions{
+			Header:      options.APIKeyAuthOptions.Header,
+			Keys:        options.APIKeyAuthOptions.Keys,
+			URLPrefixes: options.APIKeyAuthOptions.URLPrefixes,
+			AllowBearer: options.APIKeyAuthOptions.AllowBearer,
+		}))
+	}
+	var jwtAuth *msm.JwtAuthenticator
 	if !options.DisableOIDCMiddleware {
-		jwtAuth := msm.NewJWTAuthenticator(options.OIDCOptions.Audience, options.OIDCOptions.Issuer, options.OIDCOptions.JwksURL,
-			options.OIDCOptions.PublicURLsPrefixes)
+		jwtAuth = msm.NewJWTAuthenticatorWithOptions(msm.JWTAuthenticatorOptions{
+			Audience:              options.OIDCOptions.Audience,
+			Audiences:             options.OIDCOptions.Audiences,
+			SkipAudienceCheck:     options.OIDCOptions.SkipAudienceCheck,
+			AllowMissingAudience:  options.OIDCOptions.AllowMissingAudience,
+			Issuer:                options.OIDCOptions.Issuer,
+			AllowMissingIssuer:    options.OIDCOptions.AllowMissingIssuer,
+			JwksURL:               options.OIDCOptions.JwksURL,
+			JwksFile:              options.OIDCOptions.JwksFile,
+			JwksInline:            options.OIDCOptions.JwksInline,
+			PublicURLPrefixes:     options.OIDCOptions.PublicURLsPrefixes,
+			PublicURLPatterns:     publicURLPatterns,
+			PublicURLs:            options.OIDCOptions.PublicURLs,
+			ClockSkew:             options.OIDCOptions.ClockSkew,
+			TokenCacheSize:        options.OIDCOptions.TokenCacheSize,
+			LogLatency:            options.OIDCOptions.LogAuthLatency,
+			JwksUserAgent:         options.OIDCOptions.JwksUserAgent,
+			JwksRequestHeaders:    options.OIDCOptions.JwksRequestHeaders,
+			JwksHTTPClient:        options.OIDCOptions.JwksHTTPClient,
+			AllowedTokenTypes:     options.OIDCOptions.AllowedTokenTypes,
+			AllowMissingTokenType: options.OIDCOptions.AllowMissingTokenType,
+			ClaimValidators:       options.OIDCOptions.ClaimValidators,
+			IntrospectionURL:      options.OIDCOptions.IntrospectionURL,
+			ClientID:              options.OIDCOptions.ClientID,
+			ClientSecret:          options.OIDCOptions.ClientSecret,
+		})
 		r.Use(jwtAuth.GetHandler())
-		r.Use(msm.NewContextSetter(options.ContextSetterOptions.ClaimToContextKeyMapping))
+		jwtAuth.SetRoutes(r)
+		r.Use(msm.NewContextSetterWithOptions(msm.ContextSetterOptions{
+			ClaimToContextKeyMapping: options.ContextSetterOptions.ClaimToContextKeyMapping,
+			SkipMissingClaims:        options.ContextSetterOptions.SkipMissingClaims,
+			OptionalClaims:           options.ContextSetterOptions.OptionalClaims,
+			OmitUserLogField:         options.ContextSetterOptions.OmitUserLogField,
+		}))
+		if options.UserInfoOptions != nil {
+			r.Use(msm.NewUserInfoSetter(options.UserInfoOptions.UserClaim,
+				options.UserInfoOptions.RolesClaim, options.UserInfoOptions.AdminRole))
+		}
+	}
+	if rateLimiter != nil && options.RateLimitOptions.KeyFunc != nil {
+		r.Use(rateLimiter.GetHandler())
 	}
 
 	if routesRegistrationHandler != nil {
 		routesRegistrationHandler(r)
 	}
 
+	server, err := newHTTPServer(options, r)
+	if err != nil {
+		return nil, logger, err
+	}
+
+	var adminServer *http.Server
+	if options.AdminRoutes != nil || options.AdminOpsEndpoints {
+		adminServer = newAdminServer(options, newAdminMux(logger, options, metrics))
+	}
+
+	s := &ChiServer{
+		options:     options,
+		logger:      logger,
+		mux:         r,
+		server:      server,
+		adminServer: adminServer,
+		stopped:     make(chan struct{}),
+		jwtAuth:     jwtAuth,
+		metrics:     metrics,
+		active:      activeRequests,
+	}
+	if options.OnShutdown != nil {
+		s.RegisterShutdownHook(options.OnShutdown)
+	}
+	return s, logger, nil
+}
+
+// newHTTPServer returns the http.Server of the main listener serving the handler, with
+// HTTP/2 cleartext support if it's enabled
+func newHTTPServer(options *ChiServerOptions, handler http.Handler) (*http.Server, error) {
+	server := &http.Server{
+		Addr:    net.JoinHostPort(options.BindAddress, strconv.Itoa(options.HTTPPort)),
+		Handler: handler,
+	}
+	setTimeouts(server, options)
+	if options.EnableH2C {
+		h2s := &http2.Server{}
+		// makes Shutdown() send GOAWAY to HTTP/2 connections
+		if err := http2.ConfigureServer(server, h2s); err != nil {
+			return nil, fmt.Errorf("can't configure HTTP/2 server: %v", err)
+		}
+		server.Handler = h2c.NewHandler(handler, h2s)
+	}
+	return server, nil
+}
+
+// newAdminServer returns the http.Server of the admin listener serving the handler
+func newAdminServer(options *ChiServerOptions, handler http.Handler) *http.Server {
 	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", options.HTTPPort),
-		Handler: r,
+		Addr:    net.JoinHostPort(options.AdminBindAddress, strconv.Itoa(options.AdminPort)),
+		Handler: handler,
+	}
+	setTimeouts(server, options)
+	return server
+}
+
+// setTimeouts applies the configured connection timeouts to the server; zero means no timeout
+func setTimeouts(server *http.Server, options *ChiServerOptions) {
+	server.ReadHeaderTimeout = options.ReadHeaderTimeout
+	server.ReadTimeout = options.ReadTimeout
+	server.WriteTimeout = options.WriteTimeout
+	server.IdleTimeout = options.IdleTimeout
+}
+
+// newAdminMux returns the router for the admin listener; it has no authentication
+// middleware, as it's meant to be reachable only from the internal network
+func newAdminMux(logger *logrus.Logger, options *ChiServerOptions, metrics *msm.Metrics) *chi.Mux {
+	r := chi.NewRouter()
+	if !options.DisableRequestID {
+		r.Use(middleware.RequestID)
+	}
+	r.Use(newStructuredLogger(logger, options))
+	r.Use(msm.NewRecoverer())
+	r.Use(msm.NewJSONContentType())
+	if options.AdminOpsEndpoints {
+		// registered as routes, as chi skips the middleware of a router without any routes
+		if metrics != nil {
+			metricsHandler := msm.NewMetricsEndpoint(options.MetricsPath, metrics.Registry())(http.NotFoundHandler())
+			r.Method(http.MethodGet, options.MetricsPath, metricsHandler)
+			r.Method(http.MethodHead, options.MetricsPath, metricsHandler)
+		}
+		if !options.DisableHeartbeat {
+			healthHandler := msm.NewHealthChecks(options.ReadinessChecks)(http.NotFoundHandler())
+			r.Method(http.MethodGet, msm.LivenessPath, healthHandler)
+			r.Method(http.MethodGet, msm.ReadinessPath, healthHandler)
+		}
+	}
+	if options.AdminRoutes != nil {
+		options.AdminRoutes(r)
+	}
+	return r
+}
+
+// newStructuredLogger returns the request logging middleware configured from options
+func newStructuredLogger(logger *logrus.Logger, options *ChiServerOptions) func(next http.Handler) http.Handler {
+	return msm.NewStructuredLoggerWithOptions(logger, msm.StructuredLoggerOptions{
+		ExtraFields:          options.LoggerFields,
+		ExtraFieldFuncs:      options.LoggerFieldFuncs,
+		CompletionFieldFuncs: options.LoggerCompletionFuncs,
+		RequestHeaders:       options.LogRequestHeaders,
+		SkipPaths:            options.LogSkipPaths,
+		OmitPanicStack:       options.LogOmitPanicStack,
+		TimestampField:       options.LogTimestampField,
+		TimestampFormat:      options.LogTimestampFormat,
+		Format:               options.LogFormat,
+		SampleRate:           options.LogSampleRate,
+		OmitRequestStarted:   options.LogOmitRequestStarted,
+	})
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q in server configuration: %v", pattern, err)
+		}
+		compiled = append(compiled, re)
 	}
+	return compiled, nil
+}
 
-	return &ChiServer{
-		options:  options,
-		logger:   logger,
-		mux:      r,
-		server:   server,
-		stopChan: make(chan interface{}, 1),
+// parseCIDRs parses networks in the CIDR notation; single IPs are accepted as well
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q in server configuration: %v", cidr, err)
+		}
+		networks = append(networks, network)
 	}
+	return networks, nil
+}
+
+// Router returns the chi router of the server, so routes and sub-routers can be mounted
+// after the server was created, e.g. srv.Router().Mount("/admin", adminRouter).
+// The server middleware stack is set up before the registration callback is called, so
+// it applies to all the routes added here. Global middleware added here with Use()
+// doesn't apply to already registered routes (chi panics in that case); use Group()
+// or With() instead. Routes have to be added before Run() is called.
+func (s *ChiServer) Router() *chi.Mux {
+	return s.mux
+}
+
+// Handler returns the router with the whole middleware chain, without binding any port.
+// It can be served with httptest.NewServer() or called directly with ServeHTTP(), which
+// makes the server testable deterministically, without Run() and port contention.
+func (s *ChiServer) Handler() http.Handler {
+	return s.mux
 }
 
 // GetRoutesDocs returns a JSON string describing all the registered routes
@@ -141,48 +709,285 @@ func (s *ChiServer) GetRoutesDocs() string {
 	return docgen.JSONRoutesDoc(s.mux)
 }
 
-// Run starts the listeners, blocks and waits for interruption signal to quit
+// Run starts the listeners, blocks and waits for interruption signal to quit.
+// If Stop() was already called, Run() returns immediately without starting the server.
+// Run panics if the server can't listen or serve requests; use RunWithError() to handle
+// such errors.
 func (s *ChiServer) Run() {
-	s.logger.Infof("Starting HTTP server on port :%d...", s.options.HTTPPort)
+	s.RunWithContext(context.Background())
+}
+
+// RunWithContext works like Run(), but additionally stops the server and returns when
+// ctx is cancelled.
+func (s *ChiServer) RunWithContext(ctx context.Context) {
+	if err := s.run(ctx); err != nil {
+		s.logger.Panicf("%v\n", err)
+	}
+}
 
+// RunWithError works like Run(), but returns listening and serving errors, like
+// "address already in use", to the caller instead of panicking.
+func (s *ChiServer) RunWithError() error {
+	return s.run(context.Background())
+}
+
+func (s *ChiServer) run(ctx context.Context) error {
+	s.stateLock.Lock()
+	if s.state != stateNew {
+		s.stateLock.Unlock()
+		s.logger.Infof("Server was already started or stopped, not starting it again")
+		return nil
+	}
+	s.state = stateRunning
+	s.stateLock.Unlock()
+
+	listener, adminListener, err := s.listen()
+	if err != nil {
+		s.stateLock.Lock()
+		s.markStopped()
+		s.stateLock.Unlock()
+		return err
+	}
+	s.listener = listener
+	if s.jwtAuth != nil && s.options.OIDCOptions.JwksRefreshInterval > 0 {
+		s.jwtAuth.StartKeyRefresh(s.options.OIDCOptions.JwksRefreshInterval, s.logger)
+	}
+
+	// the main server always reports when it's done serving, the admin one only on errors;
+	// the buffer fits both, so the serving goroutines never block
+	serveErr := make(chan error, 2)
 	go func() {
 		s.logger.Infof("Server started")
-		s.started = true
-		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			s.logger.Panicf("Could not listen on port %d: %v\n", s.options.HTTPPort, err)
+		err := s.server.Serve(listener)
+		if err == http.ErrServerClosed {
+			err = nil
+		} else if err != nil {
+			err = fmt.Errorf("could not serve on address %s: %v", listener.Addr(), err)
 		}
-		s.stopChan <- ""
+		serveErr <- err
 	}()
+	if adminListener != nil {
+		go func() {
+			if err := s.adminServer.Serve(adminListener); err != nil && err != http.ErrServerClosed {
+				serveErr <- fmt.Errorf("could not serve on admin address %s: %v", adminListener.Addr(), err)
+			}
+		}()
+	}
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
+	defer signal.Stop(c)
+	// Stop() called by another goroutine shuts down the http.Server, which ends Serve()
+	// and wakes us up here, so all the paths end up in the same Stop() call below
 	select {
 	case <-c:
-	case <-s.stopChan:
+	case <-ctx.Done():
+	case err = <-serveErr:
 	}
 
 	s.Stop()
+	<-s.stopped
+	return err
 }
 
-// Stop stops listening on server ports. Stopped server can't be Run() again.
+// listen creates the listeners for the main and, if configured, admin server
+func (s *ChiServer) listen() (net.Listener, net.Listener, error) {
+	var listener net.Listener
+	var err error
+	if s.options.UnixSocketPath != "" {
+		s.logger.Infof("Starting HTTP server on unix socket %s...", s.options.UnixSocketPath)
+		listener, err = listenUnix(s.options.UnixSocketPath)
+	} else {
+		s.logger.Infof("Starting HTTP server on %s...", s.server.Addr)
+		listener, err = net.Listen("tcp", s.server.Addr)
+		if err != nil {
+			err = fmt.Errorf("could not listen on address %s: %v", s.server.Addr, err)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.adminServer == nil {
+		return listener, nil, nil
+	}
+
+	s.logger.Infof("Starting admin HTTP server on %s...", s.adminServer.Addr)
+	adminListener, err := net.Listen("tcp", s.adminServer.Addr)
+	if err != nil {
+		listener.Close()
+		return nil, nil, fmt.Errorf("could not listen on admin address %s: %v", s.adminServer.Addr, err)
+	}
+	return listener, adminListener, nil
+}
+
+// listenUnix creates a listener on a unix domain socket, removing a stale socket
+// file left behind by a previous run
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("can't listen on unix socket %s: file exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("can't remove stale unix socket %s: %v", path, err)
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on unix socket %s: %v", path, err)
+	}
+	return listener, nil
+}
+
+// Stop stops listening on server ports. Stopped server can't be Run() again, unless
+// Reset() is called first.
+// Calling Stop() before or while Run() is starting prevents the server from running.
+// It's safe to call Stop() many times and from many goroutines, e.g. from a signal handler
+// and a test cleanup; only the first call shuts the server down, the others are no-ops.
 func (s *ChiServer) Stop() {
-	if !s.started {
+	if s.jwtAuth != nil {
+		s.jwtAuth.StopKeyRefresh()
+	}
+	s.stateLock.Lock()
+	switch s.state {
+	case stateNew:
+		s.markStopped()
+		s.stateLock.Unlock()
+		return
+	case stateStopping, stateStopped:
+		s.stateLock.Unlock()
 		return
 	}
-	s.logger.Infof("Stopping the server...")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	s.state = stateStopping
+	s.stateLock.Unlock()
+
+	inFlight := s.active.Active()
+	s.logger.WithField("in_flight_requests", inFlight).Infof("Stopping the server, draining %d active requests...", inFlight)
+	drainStart := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.options.GracefulShutdownTimeSec)*time.Second)
 	defer cancel()
 
 	s.server.SetKeepAlivesEnabled(false)
-	if err := s.server.Shutdown(ctx); err != nil {
+	if err := s.server.Shutdown(ctx); err != nil && err != ctx.Err() {
 		s.logger.Errorf("Error shutting down server: %v", err)
 	}
-	s.started = false
-	s.stopChan <- ""
-	s.logger.Infof("Shutdown done")
+	if s.options.EnableH2C {
+		// h2c connections are hijacked from the http.Server, so Shutdown() doesn't wait for them
+		s.waitForActiveRequests(ctx)
+	}
+	if s.adminServer != nil {
+		s.adminServer.SetKeepAlivesEnabled(false)
+		if err := s.adminServer.Shutdown(ctx); err != nil && err != ctx.Err() {
+			s.logger.Errorf("Error shutting down admin server: %v", err)
+		}
+	}
+	var forceClosed int64
+	if ctx.Err() != nil {
+		forceClosed = s.active.Active()
+		s.logger.WithField("force_closed_requests", forceClosed).Warnf(
+			"Graceful shutdown timed out, force closing %d active requests", forceClosed)
+		s.server.Close()
+		if s.adminServer != nil {
+			s.adminServer.Close()
+		}
+	}
+	if s.options.UnixSocketPath != "" {
+		if err := os.Remove(s.options.UnixSocketPath); err != nil && !os.IsNotExist(err) {
+			s.logger.Errorf("Error removing unix socket %s: %v", s.options.UnixSocketPath, err)
+		}
+	}
+	drain := time.Since(drainStart)
+	s.runShutdownHooks()
+	s.stateLock.Lock()
+	s.markStopped()
+	s.stateLock.Unlock()
+	s.logger.WithFields(logrus.Fields{
+		"in_flight_requests":    inFlight,
+		"force_closed_requests": forceClosed,
+		"drain_duration_ms":     float64(drain.Nanoseconds()) / 1000000.0,
+	}).Infof("Shutdown done")
+}
+
+// RegisterShutdownHook registers a function called when the running server is stopped, after
+// the listeners are shut down and the requests drained, e.g. to flush buffers or close
+// database connections. Hooks run in the reverse order of registration (LIFO), the hook set
+// with the OnShutdown option first registered, so it runs last. They share a context with the
+// GracefulShutdownTimeSec timeout; their errors are logged and don't stop the other hooks.
+func (s *ChiServer) RegisterShutdownHook(hook func(context.Context) error) {
+	s.hooksLock.Lock()
+	defer s.hooksLock.Unlock()
+	s.hooks = append(s.hooks, hook)
+}
+
+// runShutdownHooks calls the registered shutdown hooks in LIFO order
+func (s *ChiServer) runShutdownHooks() {
+	s.hooksLock.Lock()
+	hooks := make([]func(context.Context) error, len(s.hooks))
+	copy(hooks, s.hooks)
+	s.hooksLock.Unlock()
+	if len(hooks) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.options.GracefulShutdownTimeSec)*time.Second)
+	defer cancel()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i](ctx); err != nil {
+			s.logger.Errorf("Error running shutdown hook: %v", err)
+		}
+	}
+}
+
+// waitForActiveRequests waits until all the requests are done or the context expires
+func (s *ChiServer) waitForActiveRequests(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for s.active.Active() > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// markStopped moves the server to the final state and releases everyone waiting for
+// the shutdown to complete. It must be called with stateLock held.
+func (s *ChiServer) markStopped() {
+	s.state = stateStopped
+	close(s.stopped)
+}
+
+// Reset prepares a stopped server to be Run() again. The http.Server instances and
+// lifecycle channels are recreated, while the router with all the middleware and routes
+// is reused, so it's a cheap way to restart a server, e.g. in test suites.
+// Reset returns an error if the server is running or stopping.
+func (s *ChiServer) Reset() error {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	if s.state == stateRunning || s.state == stateStopping {
+		return errors.New("server is running, it has to be stopped before Reset()")
+	}
+	server, err := newHTTPServer(s.options, s.mux)
+	if err != nil {
+		return err
+	}
+	s.server = server
+	if s.adminServer != nil {
+		s.adminServer = newAdminServer(s.options, s.adminServer.Handler)
+	}
+	s.listener = nil
+	s.stopped = make(chan struct{})
+	s.state = stateNew
+	return nil
+}
+
+// ActiveRequests returns the number of requests being currently served
+func (s *ChiServer) ActiveRequests() int64 {
+	return s.active.Active()
 }
 
 // IsStarted returns true only of Run() was called and listeners are already started
 func (s *ChiServer) IsStarted() bool {
-	return s.started
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	return s.state == stateRunning
 }
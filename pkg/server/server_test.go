@@ -1,36 +1,65 @@
 package server_test
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/piontec/go-chi-middleware-server/pkg/server"
 	"github.com/piontec/go-chi-middleware-server/pkg/server/middleware"
 
-	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/v5"
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/docgen"
+	"github.com/go-chi/render"
+	"github.com/golang-jwt/jwt"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"golang.org/x/net/http2"
 )
 
 type testHelper struct {
 	options *server.ChiServerOptions
 	server  *server.ChiServer
 	client  *http.Client
+	done    chan struct{}
 }
 
+// getTestHelper runs the server on the configured port; tests which don't need real
+// listeners should use newTestServer instead
 func getTestHelper(regFunction func(r *chi.Mux), options *server.ChiServerOptions) *testHelper {
-
-	if regFunction == nil {
-		regFunction = func(r *chi.Mux) {
-			r.Get("/hello", func(w http.ResponseWriter, r *http.Request) {
-				w.Write([]byte("Hello root"))
-			})
-		}
-	}
-	server := server.NewChiServer(regFunction, options)
+	server := newTestServer(regFunction, options)
+	done := make(chan struct{})
 	go func() {
 		server.Run()
+		close(done)
 	}()
 	for {
 		if server.IsStarted() {
@@ -43,36 +72,555 @@ func getTestHelper(regFunction func(r *chi.Mux), options *server.ChiServerOption
 		options: options,
 		server:  server,
 		client:  &http.Client{},
+		done:    done,
+	}
+}
+
+// newTestServer creates the server with the routes registered by regFunction, or with a
+// single "/hello" route if it's nil; it's served with its Handler(), without any listener
+func newTestServer(regFunction func(r *chi.Mux), options *server.ChiServerOptions) *server.ChiServer {
+	if regFunction == nil {
+		regFunction = func(r *chi.Mux) {
+			r.Get("/hello", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("Hello root"))
+			})
+		}
+	}
+	return server.NewChiServer(regFunction, options)
+}
+
+// serveRequest sends the request to the server's Handler() and returns the recorded response
+func serveRequest(s *server.ChiServer, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+// serveWithToken sends a GET request with the bearer token to the server's Handler() and
+// returns the status code and body
+func serveWithToken(s *server.ChiServer, path, token string) (int, string) {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
 	}
+	rec := serveRequest(s, req)
+	return rec.Code, rec.Body.String()
 }
 
+// cleanup stops the server and waits for Run() to return
 func (th *testHelper) cleanup() {
 	th.server.Stop()
+	<-th.done
 }
 
-func TestHealthcheck(t *testing.T) {
-	h := getTestHelper(nil, &server.ChiServerOptions{
-		HTTPPort:              8080,
-		DisableOIDCMiddleware: true,
-	})
-	defer h.cleanup()
+// oidcTestProvider signs JWT tokens and serves the JWKS document with the matching key
+type oidcTestProvider struct {
+	key        *rsa.PrivateKey
+	jwksServer *httptest.Server
+}
+
+func newOIDCTestProvider(t *testing.T) *oidcTestProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Can't generate RSA key: %v", err)
+	}
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test-key",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+		}},
+	}
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	return &oidcTestProvider{key: key, jwksServer: jwksServer}
+}
+
+func (p *oidcTestProvider) options() server.ChiOIDCMiddlewareOptions {
+	return server.ChiOIDCMiddlewareOptions{
+		Audience: "http://localhost",
+		Issuer:   "https://your-oidc-provider.com/",
+		JwksURL:  p.jwksServer.URL,
+	}
+}
+
+// token returns a signed token valid for an hour, with claims overriding the default ones;
+// default claims set to nil are removed
+func (p *oidcTestProvider) token(t *testing.T, claims jwt.MapClaims) string {
+	allClaims := jwt.MapClaims{
+		"aud": "http://localhost",
+		"iss": "https://your-oidc-provider.com/",
+		"sub": "test-user",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		if v == nil {
+			delete(allClaims, k)
+			continue
+		}
+		allClaims[k] = v
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, allClaims)
+	token.Header["kid"] = "test-key"
+	signed, err := token.SignedString(p.key)
+	if err != nil {
+		t.Fatalf("Can't sign JWT token: %v", err)
+	}
+	return signed
+}
 
-	time.Sleep(100 * time.Millisecond)
-	resp, err := h.client.Get("http://localhost:8080/ping")
+func (p *oidcTestProvider) close() {
+	p.jwksServer.Close()
+}
+
+// getWithToken sends a GET request with the bearer token and returns the status code and body
+func (th *testHelper) getWithToken(t *testing.T, url, token string) (int, string) {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := th.client.Do(req)
 	if err != nil {
 		t.Fatalf("Server did not respond: %v", err)
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
-
 	assert.Nil(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestHealthcheck(t *testing.T) {
+	s := newTestServer(nil, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+	})
+
+	status, body := serveWithToken(s, "/ping", "")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, ".", body)
+}
+
+func TestHandlerWithoutListener(t *testing.T) {
+	s := server.NewChiServer(func(r *chi.Mux) {
+		r.Get("/hello", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Hello root"))
+		})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+	})
+
+	// called directly
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/hello", nil))
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "Hello root", rec.Body.String())
+	assert.NotEmpty(t, rec.Header().Get("X-Request-Id"))
+
+	// served on a random port
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/ping")
+	if err != nil {
+		t.Fatalf("Server did not respond: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
 	assert.Equal(t, 200, resp.StatusCode)
 	assert.Equal(t, ".", string(body))
+	assert.False(t, s.IsStarted())
+}
+
+func TestTrustedProxies(t *testing.T) {
+	s := server.NewChiServer(func(r *chi.Mux) {
+		r.Get("/ip", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.RemoteAddr))
+		})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		TrustedProxies:        []string{"10.0.0.0/8", "192.168.1.10"},
+	})
+	clientIP := func(remoteAddr string, headers map[string]string) string {
+		req := httptest.NewRequest("GET", "/ip", nil)
+		req.RemoteAddr = remoteAddr
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+
+	// spoofed headers from untrusted peers are ignored
+	assert.Equal(t, "203.0.113.7:1234", clientIP("203.0.113.7:1234", map[string]string{"X-Real-IP": "1.2.3.4"}))
+	assert.Equal(t, "203.0.113.7:1234", clientIP("203.0.113.7:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}))
+	assert.Equal(t, "192.168.1.11:1234", clientIP("192.168.1.11:1234", map[string]string{"X-Real-IP": "1.2.3.4"}))
+
+	// trusted proxies set the client IP
+	assert.Equal(t, "1.2.3.4", clientIP("10.1.2.3:1234", map[string]string{"X-Real-IP": "1.2.3.4"}))
+	assert.Equal(t, "1.2.3.4", clientIP("192.168.1.10:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}))
+	// addresses prepended by the client are skipped
+	assert.Equal(t, "198.51.100.1",
+		clientIP("10.1.2.3:1234", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.1, 10.0.0.5"}))
+	assert.Equal(t, "10.1.2.3:1234", clientIP("10.1.2.3:1234", map[string]string{"X-Forwarded-For": "garbage"}))
+	// X-Real-IP sent by the client through a trusted proxy, which only appends to X-Forwarded-For
+	assert.Equal(t, "198.51.100.1",
+		clientIP("10.1.2.3:1234", map[string]string{"X-Real-IP": "1.2.3.4", "X-Forwarded-For": "198.51.100.1"}))
+}
+
+func TestLogFormatCombined(t *testing.T) {
+	var out bytes.Buffer
+	s := server.NewChiServer(func(r *chi.Mux) {
+		r.Get("/hello", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Hello root"))
+		})
+		r.Get("/panic", func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		LogOutput:             &out,
+		LogFormat:             middleware.LogFormatCombined,
+	})
+	serve := func(url string, header http.Header) string {
+		out.Reset()
+		req := httptest.NewRequest("GET", url, nil)
+		req.RemoteAddr = "203.0.113.7:1234"
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		s.Handler().ServeHTTP(httptest.NewRecorder(), req)
+		return out.String()
+	}
+
+	line := serve("/hello?x=1", http.Header{
+		"Referer":    {"https://example.com/"},
+		"User-Agent": {`agent "quoted"`},
+	})
+	pattern := regexp.MustCompile(`^203\.0\.113\.7 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] ` +
+		`"GET /hello\?x=1 HTTP/1\.1" 200 10 "https://example\.com/" "agent \\"quoted\\""\n$`)
+	assert.Regexp(t, pattern, line)
+
+	line = serve("/missing", http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret"))}})
+	assert.Contains(t, line, ` - alice [`)
+	assert.Contains(t, line, `"GET /missing HTTP/1.1" 404 19 "-" "-"`)
+
+	// panics are still logged with their details
+	lines := strings.Split(strings.TrimSpace(serve("/panic", nil)), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.Contains(t, lines[0], `"panic":"boom"`)
+		assert.Contains(t, lines[1], `"GET /panic HTTP/1.1" 500`)
+	}
+}
+
+func TestLogFormatCombinedConcurrentWrites(t *testing.T) {
+	var out bytes.Buffer
+	s := server.NewChiServer(func(r *chi.Mux) {
+		r.Get("/hello", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Hello root"))
+		})
+		r.Get("/panic", func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		LogOutput:             &out,
+		LogFormat:             middleware.LogFormatCombined,
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := "/hello"
+			if i%2 == 0 {
+				path = "/panic"
+			}
+			s.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		}(i)
+	}
+	wg.Wait()
+
+	// combined lines and logrus entries of panics must not be interleaved
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 75)
+	for _, line := range lines {
+		if strings.HasPrefix(line, "{") {
+			assert.Contains(t, line, `"panic":"boom"`)
+			assert.True(t, json.Valid([]byte(line)), line)
+		} else {
+			assert.Regexp(t, `^192\.0\.2\.1 - - \[.*\] "GET /(hello|panic) HTTP/1\.1" (200|500) `, line)
+		}
+	}
+}
+
+func TestLogSampling(t *testing.T) {
+	s := server.NewChiServer(func(r *chi.Mux) {
+		r.Get("/hello", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Hello root"))
+		})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		LogOutput:             ioutil.Discard,
+		LogSampleRate:         3,
+	})
+	hook := &test.Hook{}
+	s.GetLogger().AddHook(hook)
+	count := func(path string, n int) (started, completed int) {
+		hook.Reset()
+		for i := 0; i < n; i++ {
+			s.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		}
+		for _, entry := range hook.AllEntries() {
+			switch entry.Message {
+			case "request started":
+				started++
+			case "request complete":
+				completed++
+			}
+		}
+		return started, completed
+	}
+
+	started, completed := count("/hello", 6)
+	assert.Equal(t, 2, started)
+	assert.Equal(t, 2, completed)
+	// errors are always logged, but only sampled requests have the start entry
+	started, completed = count("/missing", 3)
+	assert.Equal(t, 1, started)
+	assert.Equal(t, 3, completed)
+}
+
+func TestLogOmitRequestStarted(t *testing.T) {
+	s := server.NewChiServer(func(r *chi.Mux) {
+		r.Get("/hello", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Hello root"))
+		})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		LogOutput:             ioutil.Discard,
+		LogOmitRequestStarted: true,
+	})
+	hook := &test.Hook{}
+	s.GetLogger().AddHook(hook)
+	s.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/hello", nil))
+
+	if assert.Len(t, hook.AllEntries(), 1) {
+		entry := hook.LastEntry()
+		assert.Equal(t, "request complete", entry.Message)
+		assert.Equal(t, "GET", entry.Data["http_method"])
+		assert.Equal(t, "http://example.com/hello", entry.Data["uri"])
+		assert.Equal(t, 200, entry.Data["resp_status"])
+	}
+}
+
+func TestBasicAuthWithOIDC(t *testing.T) {
+	provider := newOIDCTestProvider(t)
+	defer provider.close()
+	s := server.NewChiServer(func(r *chi.Mux) {
+		r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
+			user, _ := middleware.GetUser(r)
+			w.Write([]byte(user))
+		})
+	}, &server.ChiServerOptions{
+		OIDCOptions:     provider.options(),
+		UserInfoOptions: &server.ChiUserInfoOptions{},
+		BasicAuthOptions: &server.ChiBasicAuthOptions{
+			Users:       map[string]string{"svc": "s3cret"},
+			URLPrefixes: []string{"/internal"},
+			AllowBearer: true,
+		},
+	})
+	serve := func(path string, setAuth func(r *http.Request)) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		setAuth(req)
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+	basic := func(password string) func(r *http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth("svc", password) }
+	}
+	bearer := func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+provider.token(t, nil)) }
+
+	status, body := serve("/internal/jobs", basic("s3cret"))
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "svc", body)
+	status, _ = serve("/internal/jobs", basic("wrong"))
+	assert.Equal(t, 401, status)
+	status, body = serve("/internal/jobs", bearer)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "test-user", body)
+	status, _ = serve("/internal/jobs", func(r *http.Request) {})
+	assert.Equal(t, 401, status)
+
+	// other paths accept only OIDC
+	status, _ = serve("/api/items", basic("s3cret"))
+	assert.Equal(t, 401, status)
+	status, _ = serve("/api/items", bearer)
+	assert.Equal(t, 200, status)
+}
+
+func TestAPIKeyAuthWithOIDC(t *testing.T) {
+	provider := newOIDCTestProvider(t)
+	defer provider.close()
+	s := server.NewChiServer(func(r *chi.Mux) {
+		r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
+			user, _ := middleware.GetUser(r)
+			w.Write([]byte(user))
+		})
+	}, &server.ChiServerOptions{
+		OIDCOptions:     provider.options(),
+		UserInfoOptions: &server.ChiUserInfoOptions{},
+		APIKeyAuthOptions: &server.ChiAPIKeyAuthOptions{
+			Keys:        map[string]string{"s3cret-key": "reports"},
+			URLPrefixes: []string{"/internal"},
+		},
+	})
+	serve := func(path string, headers map[string]string) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+	bearer := map[string]string{"Authorization": "Bearer " + provider.token(t, nil)}
+
+	status, body := serve("/internal/reports", map[string]string{"X-Api-Key": "s3cret-key"})
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "reports", body)
+	status, _ = serve("/internal/reports", map[string]string{"X-Api-Key": "wrong"})
+	assert.Equal(t, 401, status)
+	// without AllowBearer, keyed paths accept only API keys
+	status, _ = serve("/internal/reports", bearer)
+	assert.Equal(t, 401, status)
+
+	// OIDC protected paths coexist with the keyed ones
+	status, _ = serve("/api/items", map[string]string{"X-Api-Key": "s3cret-key"})
+	assert.Equal(t, 401, status)
+	status, body = serve("/api/items", bearer)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "test-user", body)
+}
+
+func TestPublicRoutes(t *testing.T) {
+	provider := newOIDCTestProvider(t)
+	defer provider.close()
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}
+	s := server.NewChiServer(func(r *chi.Mux) {
+		r.Method("GET", "/docs", middleware.Public(http.HandlerFunc(ok)))
+		r.With(middleware.PublicRoute).Get("/items/{id}", ok)
+		r.Post("/items/{id}", ok)
+		r.Get("/private", ok)
+		r.Route("/v2", func(r chi.Router) {
+			r.With(middleware.PublicRoute).Get("/status", ok)
+			r.Get("/private", ok)
+		})
+	}, &server.ChiServerOptions{
+		OIDCOptions: provider.options(),
+	})
+	s.Router().Mount("/admin", func() http.Handler {
+		r := chi.NewRouter()
+		r.With(middleware.PublicRoute).Get("/info", ok)
+		r.Get("/settings", ok)
+		return r
+	}())
+	serve := func(method, path string) int {
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, 200, serve("GET", "/docs"))
+	assert.Equal(t, 200, serve("GET", "/items/1"))
+	assert.Equal(t, 200, serve("GET", "/v2/status"))
+	assert.Equal(t, 200, serve("GET", "/admin/info"))
+	// only the marked method of a path is public
+	assert.Equal(t, 401, serve("POST", "/items/1"))
+	assert.Equal(t, 401, serve("GET", "/private"))
+	assert.Equal(t, 401, serve("GET", "/v2/private"))
+	assert.Equal(t, 401, serve("GET", "/admin/settings"))
+	assert.Equal(t, 401, serve("GET", "/unknown"))
+}
+
+func TestSecurityHeadersOnRejectedRequests(t *testing.T) {
+	provider := newOIDCTestProvider(t)
+	defer provider.close()
+	s := server.NewChiServer(func(r *chi.Mux) {
+		r.Get("/hello", func(w http.ResponseWriter, r *http.Request) {})
+	}, &server.ChiServerOptions{
+		OIDCOptions:            provider.options(),
+		SecurityHeadersOptions: &server.ChiSecurityHeadersOptions{ContentSecurityPolicy: "default-src 'none'", AlwaysSendHSTS: true},
+	})
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/hello", nil))
+	assert.Equal(t, 401, rec.Code)
+	assert.Equal(t, "nosniff", rec.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "default-src 'none'", rec.Header().Get("Content-Security-Policy"))
+	assert.Equal(t, "max-age=31536000; includeSubDomains", rec.Header().Get("Strict-Transport-Security"))
+}
+
+func TestUserLogField(t *testing.T) {
+	provider := newOIDCTestProvider(t)
+	defer provider.close()
+	oidcOptions := provider.options()
+	oidcOptions.PublicURLsPrefixes = []string{"/pub"}
+	s := server.NewChiServer(func(r *chi.Mux) {
+		r.Get("/*", func(w http.ResponseWriter, r *http.Request) {})
+	}, &server.ChiServerOptions{
+		OIDCOptions:           oidcOptions,
+		LogOmitRequestStarted: true,
+	})
+	hook := &test.Hook{}
+	s.GetLogger().AddHook(hook)
+
+	req := httptest.NewRequest("GET", "/hello", nil)
+	req.Header.Set("Authorization", "Bearer "+provider.token(t, nil))
+	s.Handler().ServeHTTP(httptest.NewRecorder(), req)
+	if assert.Len(t, hook.AllEntries(), 1) {
+		assert.Equal(t, "request complete", hook.LastEntry().Message)
+		assert.Equal(t, "test-user", hook.LastEntry().Data["user"])
+	}
+
+	// public requests have no user, even with a token
+	hook.Reset()
+	req = httptest.NewRequest("GET", "/pub/docs", nil)
+	req.Header.Set("Authorization", "Bearer "+provider.token(t, nil))
+	s.Handler().ServeHTTP(httptest.NewRecorder(), req)
+	if assert.Len(t, hook.AllEntries(), 1) {
+		_, found := hook.LastEntry().Data["user"]
+		assert.False(t, found)
+	}
+}
+
+func TestHeartbeatPathAndBody(t *testing.T) {
+	s := newTestServer(nil, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		HeartbeatPath:         "/healthz",
+		HeartbeatBody:         `{"status":"ok"}`,
+	})
+
+	rec := serveRequest(s, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.Equal(t, `{"status":"ok"}`, rec.Body.String())
+
+	// the default path isn't served anymore
+	status, _ := serveWithToken(s, "/ping", "")
+	assert.Equal(t, 404, status)
 }
 
 func TestPublicPath(t *testing.T) {
-	h := getTestHelper(nil, &server.ChiServerOptions{
-		HTTPPort:              8080,
+	s := newTestServer(nil, &server.ChiServerOptions{
 		DisableOIDCMiddleware: true,
 		OIDCOptions: server.ChiOIDCMiddlewareOptions{
 			Audience:           "http://localhost",
@@ -81,19 +629,10 @@ func TestPublicPath(t *testing.T) {
 			PublicURLsPrefixes: []string{"/hello"},
 		},
 	})
-	defer h.cleanup()
-
-	time.Sleep(100 * time.Millisecond)
-	resp, err := h.client.Get("http://localhost:8080/hello")
-	if err != nil {
-		t.Fatalf("Server did not respond: %v", err)
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
 
-	assert.Nil(t, err)
-	assert.Equal(t, 200, resp.StatusCode)
-	assert.Equal(t, "Hello root", string(body))
+	status, body := serveWithToken(s, "/hello", "")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "Hello root", body)
 }
 
 func TestLoggerFieldFuncs(t *testing.T) {
@@ -103,19 +642,1748 @@ func TestLoggerFieldFuncs(t *testing.T) {
 		callCounter++
 		return "done1"
 	}
-	h := getTestHelper(nil, &server.ChiServerOptions{
-		HTTPPort:              8080,
+	s := newTestServer(nil, &server.ChiServerOptions{
 		DisableOIDCMiddleware: true,
 		LoggerFieldFuncs:      lfc,
 	})
-	defer h.cleanup()
 
-	time.Sleep(100 * time.Millisecond)
-	resp, err := h.client.Get("http://localhost:8080/hello")
+	serveWithToken(s, "/hello", "")
+	assert.Equal(t, 1, callCounter)
+}
+
+func TestLoggerCompletionFuncs(t *testing.T) {
+	s := newTestServer(func(r *chi.Mux) {
+		r.Get("/traced", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Upstream-Trace-Id", "abc123")
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte("queued"))
+		})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		LoggerCompletionFuncs: middleware.LogrusCompletionFieldFuncs{
+			"upstream_trace_id": func(r *http.Request, status, bytes int, header http.Header) string {
+				return header.Get("X-Upstream-Trace-Id")
+			},
+			"summary": func(r *http.Request, status, bytes int, header http.Header) string {
+				return fmt.Sprintf("%s %s %d %d", r.Method, r.URL.Path, status, bytes)
+			},
+		},
+	})
+	hook := &test.Hook{}
+	s.GetLogger().AddHook(hook)
+
+	status, _ := serveWithToken(s, "/traced", "")
+	assert.Equal(t, http.StatusAccepted, status)
+	entries := hook.AllEntries()
+	if assert.Len(t, entries, 2) {
+		_, found := entries[0].Data["upstream_trace_id"]
+		assert.False(t, found, "completion fields must not be in the request started entry")
+		assert.Equal(t, "request complete", entries[1].Message)
+		assert.Equal(t, "abc123", entries[1].Data["upstream_trace_id"])
+		assert.Equal(t, "GET /traced 202 6", entries[1].Data["summary"])
+	}
+}
+
+func TestLoggerFieldsConcurrentRequests(t *testing.T) {
+	lfc := middleware.LogrusFieldFuncs{
+		"path": func(r *http.Request) string {
+			return r.URL.Path
+		},
+	}
+	extraFields := logrus.Fields{"service": "test"}
+	s := newTestServer(func(r *chi.Mux) {
+		r.Get("/items/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		LoggerFields:          extraFields,
+		LoggerFieldFuncs:      lfc,
+	})
+	hook := &test.Hook{}
+	s.GetLogger().AddHook(hook)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			serveWithToken(s, fmt.Sprintf("/items/%d", i), "")
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, logrus.Fields{"service": "test"}, extraFields, "LoggerFields must not be modified")
+	completed := 0
+	for _, entry := range hook.AllEntries() {
+		if entry.Message != "request complete" {
+			continue
+		}
+		completed++
+		assert.Equal(t, "test", entry.Data["service"])
+		assert.True(t, strings.HasSuffix(entry.Data["uri"].(string), entry.Data["path"].(string)),
+			"fields of other requests must not leak into the entry")
+	}
+	assert.Equal(t, 20, completed)
+}
+
+func TestReadOnlyMode(t *testing.T) {
+	s := newTestServer(func(r *chi.Mux) {
+		r.Get("/hello", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Hello root"))
+		})
+		r.Head("/hello", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		r.Options("/hello", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})
+		r.Post("/hello", func(w http.ResponseWriter, r *http.Request) {
+			t.Error("POST handler must not be called in read-only mode")
+		})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		ReadOnlyMode:          true,
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/hello", strings.NewReader("{}"))
+	req.Header.Set("Content-Type", "application/json")
+	rec := serveRequest(s, req)
+	assert.Equal(t, 405, rec.Code)
+	assert.Equal(t, "GET, HEAD, OPTIONS", rec.Header().Get("Allow"))
+	assert.Contains(t, rec.Body.String(), "Method not allowed.")
+
+	status, body := serveWithToken(s, "/hello", "")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "Hello root", body)
+
+	assert.Equal(t, 200, serveRequest(s, httptest.NewRequest(http.MethodHead, "/hello", nil)).Code)
+	assert.Equal(t, 204, serveRequest(s, httptest.NewRequest(http.MethodOptions, "/hello", nil)).Code)
+
+	// health endpoints stay available in read-only mode
+	status, body = serveWithToken(s, "/ping", "")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, ".", body)
+}
+
+func TestStreamNDJSON(t *testing.T) {
+	proceed := make(chan struct{})
+	s := newTestServer(func(r *chi.Mux) {
+		r.Get("/stream", func(w http.ResponseWriter, r *http.Request) {
+			ch := make(chan interface{})
+			go func() {
+				defer close(ch)
+				ch <- map[string]int{"id": 1}
+				// the second record is sent only after the client received the first one
+				<-proceed
+				ch <- map[string]int{"id": 2}
+			}()
+			middleware.StreamNDJSON(w, ch)
+		})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+	})
+	hook := &test.Hook{}
+	s.GetLogger().AddHook(hook)
+	// flushing needs a real connection, but any port will do
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/stream")
 	if err != nil {
 		t.Fatalf("Server did not respond: %v", err)
 	}
 	defer resp.Body.Close()
+	assert.Equal(t, middleware.ContentTypeNDJSON, resp.Header.Get("Content-Type"))
 
-	assert.Equal(t, 1, callCounter)
+	reader := bufio.NewReader(resp.Body)
+	firstLine := make(chan string, 1)
+	go func() {
+		line, _ := reader.ReadString('\n')
+		firstLine <- line
+	}()
+	select {
+	case line := <-firstLine:
+		assert.Equal(t, "{\"id\":1}\n", line)
+	case <-time.After(2 * time.Second):
+		close(proceed)
+		t.Fatalf("First record was not flushed to the client")
+	}
+	close(proceed)
+	rest, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"id\":2}\n", string(rest))
+
+	// Close() waits for the handler to return, so the request is logged
+	ts.Close()
+	entry := hook.LastEntry()
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, "request complete", entry.Message)
+		assert.Equal(t, 18, entry.Data["resp_bytes_length"])
+	}
+}
+
+func TestUserAgentFilter(t *testing.T) {
+	s := newTestServer(nil, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		UserAgentFilterOptions: &server.ChiUserAgentFilterOptions{
+			BlockPatterns: []string{"(?i)sqlmap"},
+		},
+	})
+
+	for _, tc := range []struct {
+		path      string
+		userAgent string
+		status    int
+	}{
+		{"/hello", "", 400},
+		{"/hello", "sqlmap/1.4", 400},
+		{"/hello", "Mozilla/5.0", 200},
+		{"/ping", "", 200},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.Header.Set("User-Agent", tc.userAgent)
+		assert.Equal(t, tc.status, serveRequest(s, req).Code, "User-Agent %q on %s", tc.userAgent, tc.path)
+	}
+}
+
+func TestStopDuringStartup(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		s := server.NewChiServer(nil, &server.ChiServerOptions{
+			HTTPPort:              8080,
+			DisableOIDCMiddleware: true,
+		})
+		done := make(chan struct{})
+		go func() {
+			s.Run()
+			close(done)
+		}()
+		s.Stop()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Run() did not return after Stop()")
+		}
+		assert.False(t, s.IsStarted())
+		_, err := http.Get("http://localhost:8080/ping")
+		assert.NotNil(t, err, "server must not be listening after Stop()")
+	}
+}
+
+func TestRootResponse(t *testing.T) {
+	s := newTestServer(nil, &server.ChiServerOptions{
+		OIDCOptions: server.ChiOIDCMiddlewareOptions{
+			Audience: "http://localhost",
+			Issuer:   "https://your-oidc-provider.com/",
+			JwksURL:  "https://your-oidc-provider.com/.well-known/jwks.json",
+		},
+		RootOptions: &server.ChiRootOptions{
+			Info: map[string]interface{}{"service": "test"},
+		},
+	})
+
+	status, body := serveWithToken(s, "/", "")
+	assert.Equal(t, 200, status)
+	assert.JSONEq(t, `{"service":"test"}`, body)
+}
+
+func TestRootRedirect(t *testing.T) {
+	s := newTestServer(nil, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		RootOptions: &server.ChiRootOptions{
+			RedirectURL: "/docs",
+		},
+	})
+
+	rec := serveRequest(s, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, 302, rec.Code)
+	assert.Equal(t, "/docs", rec.Header().Get("Location"))
+}
+
+func TestLivenessAndReadiness(t *testing.T) {
+	var dbErr atomic.Value
+	dbErr.Store("")
+	s := newTestServer(nil, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		ReadinessChecks: middleware.ReadinessChecks{
+			"db": func(ctx context.Context) error {
+				if msg := dbErr.Load().(string); msg != "" {
+					return errors.New(msg)
+				}
+				return nil
+			},
+		},
+	})
+
+	status, body := serveWithToken(s, "/readyz", "")
+	assert.Equal(t, 200, status)
+	assert.JSONEq(t, `{"status":"ready"}`, body)
+
+	dbErr.Store("connection refused")
+	status, body = serveWithToken(s, "/readyz", "")
+	assert.Equal(t, 503, status)
+	assert.JSONEq(t, `{"status":"not ready","failed_checks":{"db":"connection refused"}}`, body)
+
+	status, _ = serveWithToken(s, "/livez", "")
+	assert.Equal(t, 200, status)
+}
+
+func TestAuthLatencyLogging(t *testing.T) {
+	provider := newOIDCTestProvider(t)
+	defer provider.close()
+	oidcOptions := provider.options()
+	oidcOptions.LogAuthLatency = true
+	s := newTestServer(nil, &server.ChiServerOptions{
+		OIDCOptions: oidcOptions,
+	})
+	hook := &test.Hook{}
+	s.GetLogger().AddHook(hook)
+
+	status, body := serveWithToken(s, "/hello", provider.token(t, nil))
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "Hello root", body)
+
+	entry := hook.LastEntry()
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, "request complete", entry.Message)
+		latency, ok := entry.Data["auth_latency_ms"].(float64)
+		assert.True(t, ok)
+		assert.True(t, latency > 0)
+	}
+}
+
+func TestGracefulShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	h := getTestHelper(func(r *chi.Mux) {
+		r.Get("/slow", func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			// longer than the former hard-coded 5s shutdown timeout
+			time.Sleep(6 * time.Second)
+			w.Write([]byte("done"))
+		})
+	}, &server.ChiServerOptions{
+		HTTPPort:                8080,
+		DisableOIDCMiddleware:   true,
+		GracefulShutdownTimeSec: 10,
+	})
+	defer h.cleanup()
+
+	type result struct {
+		status int
+		body   string
+	}
+	results := make(chan result, 1)
+	go func() {
+		status, body := h.getWithToken(t, "http://localhost:8080/slow", "")
+		results <- result{status, body}
+	}()
+	<-started
+	h.server.Stop()
+
+	select {
+	case res := <-results:
+		assert.Equal(t, 200, res.status)
+		assert.Equal(t, "done", res.body)
+	case <-time.After(time.Second):
+		t.Fatalf("Slow request was not completed during graceful shutdown")
+	}
+}
+
+func TestShutdownForceClosedLogging(t *testing.T) {
+	started := make(chan struct{})
+	h := getTestHelper(func(r *chi.Mux) {
+		r.Get("/slow", func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			time.Sleep(3 * time.Second)
+		})
+	}, &server.ChiServerOptions{
+		HTTPPort:                8080,
+		DisableOIDCMiddleware:   true,
+		GracefulShutdownTimeSec: 1,
+	})
+	defer h.cleanup()
+	hook := &test.Hook{}
+	h.server.GetLogger().AddHook(hook)
+
+	go http.Get("http://localhost:8080/slow")
+	<-started
+	start := time.Now()
+	h.server.Stop()
+	assert.True(t, time.Since(start) < 2*time.Second, "Stop() must not wait longer than the graceful timeout")
+
+	var draining, forced *logrus.Entry
+	for _, entry := range hook.AllEntries() {
+		switch {
+		case strings.HasPrefix(entry.Message, "Stopping the server"):
+			draining = entry
+		case entry.Level == logrus.WarnLevel:
+			forced = entry
+		}
+	}
+	if assert.NotNil(t, draining) {
+		assert.Equal(t, "Stopping the server, draining 1 active requests...", draining.Message)
+	}
+	if assert.NotNil(t, forced) {
+		assert.Equal(t, int64(1), forced.Data["force_closed_requests"])
+	}
+	assert.Equal(t, int64(1), hook.LastEntry().Data["force_closed_requests"])
+}
+
+func TestShutdownHooks(t *testing.T) {
+	var calls []string
+	hook := func(name string, err error) func(context.Context) error {
+		return func(ctx context.Context) error {
+			_, hasDeadline := ctx.Deadline()
+			assert.True(t, hasDeadline, "hooks must get a context with the graceful timeout")
+			calls = append(calls, name)
+			return err
+		}
+	}
+	h := getTestHelper(nil, &server.ChiServerOptions{
+		HTTPPort:              8080,
+		DisableOIDCMiddleware: true,
+		OnShutdown:            hook("option", nil),
+	})
+	defer h.cleanup()
+	h.server.RegisterShutdownHook(hook("db", errors.New("connection already closed")))
+	h.server.RegisterShutdownHook(hook("buffers", nil))
+	logHook := &test.Hook{}
+	h.server.GetLogger().AddHook(logHook)
+
+	h.server.Stop()
+	assert.Equal(t, []string{"buffers", "db", "option"}, calls)
+	var hookError *logrus.Entry
+	for _, entry := range logHook.AllEntries() {
+		if entry.Level == logrus.ErrorLevel {
+			hookError = entry
+		}
+	}
+	if assert.NotNil(t, hookError) {
+		assert.Equal(t, "Error running shutdown hook: connection already closed", hookError.Message)
+	}
+
+	// hooks run only once
+	h.server.Stop()
+	assert.Len(t, calls, 3)
+}
+
+func TestCORS(t *testing.T) {
+	provider := newOIDCTestProvider(t)
+	defer provider.close()
+	oidcOptions := provider.options()
+	oidcOptions.PublicURLsPrefixes = []string{"/pub"}
+	s := newTestServer(func(r *chi.Mux) {
+		r.Get("/hello", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Hello root"))
+		})
+		r.Get("/pub", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Hello public"))
+		})
+	}, &server.ChiServerOptions{
+		OIDCOptions: oidcOptions,
+		CORSOptions: &server.ChiCORSOptions{
+			AllowedOrigins: []string{"https://example.com"},
+			AllowedMethods: []string{"GET"},
+			AllowedHeaders: []string{"Authorization"},
+		},
+	})
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Origin", "https://example.com")
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", "GET")
+			req.Header.Set("Access-Control-Request-Headers", "Authorization")
+		}
+		return serveRequest(s, req)
+	}
+
+	// preflight to a protected path succeeds without a token
+	rec := do(http.MethodOptions, "/hello")
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "https://example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "GET", rec.Header().Get("Access-Control-Allow-Methods"))
+
+	// public paths are served with CORS headers
+	rec = do(http.MethodGet, "/pub")
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "https://example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+
+	// protected paths still require a token
+	rec = do(http.MethodGet, "/hello")
+	assert.Equal(t, 401, rec.Code)
+	assert.Equal(t, "https://example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestMethodOverride(t *testing.T) {
+	s := newTestServer(func(r *chi.Mux) {
+		r.Get("/item", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("get"))
+		})
+		r.Delete("/item", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("delete"))
+		})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		EnableMethodOverride:  true,
+	})
+	do := func(method string) string {
+		req := httptest.NewRequest(method, "/item", nil)
+		req.Header.Set("X-HTTP-Method-Override", "DELETE")
+		rec := serveRequest(s, req)
+		assert.Equal(t, 200, rec.Code)
+		return rec.Body.String()
+	}
+
+	assert.Equal(t, "delete", do(http.MethodPost))
+	assert.Equal(t, "get", do(http.MethodGet))
+}
+
+func TestOIDCSkipsPreflightRequests(t *testing.T) {
+	provider := newOIDCTestProvider(t)
+	defer provider.close()
+	s := newTestServer(nil, &server.ChiServerOptions{
+		OIDCOptions: provider.options(),
+	})
+
+	rec := serveRequest(s, httptest.NewRequest(http.MethodOptions, "/hello", nil))
+	assert.NotEqual(t, 401, rec.Code)
+
+	status, _ := serveWithToken(s, "/hello", "")
+	assert.Equal(t, 401, status)
+}
+
+func TestQueryLimits(t *testing.T) {
+	s := newTestServer(nil, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		QueryLimitsOptions: &server.ChiQueryLimitsOptions{
+			MaxParams:      3,
+			MaxValueLength: 10,
+		},
+	})
+
+	for query, expected := range map[string]int{
+		"a=1&b=2&b=3":        200,
+		"a=1&b=2&c=3&d=4":    400,
+		"a=0123456789":       200,
+		"a=0123456789abcdef": 400,
+	} {
+		status, _ := serveWithToken(s, "/hello?"+query, "")
+		assert.Equal(t, expected, status, "query %q", query)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	s := newTestServer(func(r *chi.Mux) {
+		r.Get("/slow", func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(5 * time.Second):
+				w.Write([]byte("done"))
+			}
+		})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		RequestTimeout:        100 * time.Millisecond,
+	})
+
+	start := time.Now()
+	status, _ := serveWithToken(s, "/slow", "")
+	assert.Equal(t, 504, status)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestDeadlineHeader(t *testing.T) {
+	s := newTestServer(func(r *chi.Mux) {
+		r.Get("/slow", func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(500 * time.Millisecond):
+				w.Write([]byte("done"))
+			}
+		})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		DeadlineHeader:        "X-Request-Timeout",
+	})
+	get := func(timeout string) int {
+		req := httptest.NewRequest("GET", "/slow", nil)
+		if timeout != "" {
+			req.Header.Set("X-Request-Timeout", timeout)
+		}
+		return serveRequest(s, req).Code
+	}
+
+	for _, timeout := range []string{"100m", "100ms", "0"} {
+		start := time.Now()
+		assert.Equal(t, 504, get(timeout), timeout)
+		assert.True(t, time.Since(start) < 400*time.Millisecond, timeout)
+	}
+	for _, timeout := range []string{"", "2S", "2"} {
+		assert.Equal(t, 200, get(timeout), timeout)
+	}
+	assert.Equal(t, 400, get("soon"))
+}
+
+func TestAdminRoutes(t *testing.T) {
+	h := getTestHelper(nil, &server.ChiServerOptions{
+		HTTPPort:              8080,
+		DisableOIDCMiddleware: true,
+		AdminPort:             8081,
+		AdminRoutes: func(r chi.Router) {
+			r.Get("/admin", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("Hello admin"))
+			})
+		},
+	})
+	defer h.cleanup()
+
+	status, body := h.getWithToken(t, "http://127.0.0.1:8081/admin", "")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "Hello admin", body)
+
+	// admin and main routes are isolated from each other
+	status, _ = h.getWithToken(t, "http://localhost:8080/admin", "")
+	assert.Equal(t, 404, status)
+	status, _ = h.getWithToken(t, "http://127.0.0.1:8081/hello", "")
+	assert.Equal(t, 404, status)
+
+	h.server.Stop()
+	_, err := http.Get("http://127.0.0.1:8081/admin")
+	assert.NotNil(t, err, "admin listener must be stopped with the server")
+}
+
+func TestAdminOpsEndpoints(t *testing.T) {
+	h := getTestHelper(nil, &server.ChiServerOptions{
+		HTTPPort:              8080,
+		DisableOIDCMiddleware: true,
+		EnableMetrics:         true,
+		AdminPort:             8081,
+		AdminOpsEndpoints:     true,
+	})
+	defer h.cleanup()
+
+	for _, path := range []string{"/metrics", "/livez", "/readyz"} {
+		status, _ := h.getWithToken(t, "http://127.0.0.1:8081"+path, "")
+		assert.Equal(t, 200, status, path)
+		status, _ = h.getWithToken(t, "http://localhost:8080"+path, "")
+		assert.Equal(t, 404, status, path)
+	}
+	status, _ := h.getWithToken(t, "http://localhost:8080/ping", "")
+	assert.Equal(t, 200, status)
+
+	// requests to the main listener are still measured
+	status, _ = h.getWithToken(t, "http://localhost:8080/hello", "")
+	assert.Equal(t, 200, status)
+	_, body := h.getWithToken(t, "http://127.0.0.1:8081/metrics", "")
+	assert.Contains(t, body, `http_requests_total{method="GET",path="/hello",status="200"} 1`)
+
+	h.server.Stop()
+	_, err := http.Get("http://127.0.0.1:8081/livez")
+	assert.NotNil(t, err, "admin listener must be stopped with the server")
+}
+
+func TestBindAddress(t *testing.T) {
+	h := getTestHelper(nil, &server.ChiServerOptions{
+		HTTPPort:              8080,
+		BindAddress:           "127.0.0.1",
+		DisableOIDCMiddleware: true,
+	})
+	defer h.cleanup()
+
+	status, body := h.getWithToken(t, "http://127.0.0.1:8080/hello", "")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "Hello root", body)
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chi-server")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "server.sock")
+	// leave a stale socket behind, like a crashed previous run would
+	stale, err := net.Listen("unix", socketPath)
+	assert.Nil(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	h := getTestHelper(nil, &server.ChiServerOptions{
+		UnixSocketPath:        socketPath,
+		DisableOIDCMiddleware: true,
+	})
+	defer h.cleanup()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	resp, err := client.Get("http://unix/hello")
+	if assert.Nil(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "Hello root", string(body))
+	}
+
+	h.server.Stop()
+	_, err = os.Stat(socketPath)
+	assert.True(t, os.IsNotExist(err), "socket file must be removed on Stop()")
+}
+
+func TestRunWithErrorReturnsListenError(t *testing.T) {
+	busy, err := net.Listen("tcp", ":8080")
+	if err != nil {
+		t.Fatalf("Can't occupy the test port: %v", err)
+	}
+	defer busy.Close()
+
+	s := server.NewChiServer(nil, &server.ChiServerOptions{
+		HTTPPort:              8080,
+		DisableOIDCMiddleware: true,
+	})
+	err = s.RunWithError()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "address already in use")
+	}
+	assert.False(t, s.IsStarted())
+}
+
+func TestRunWithContextStopsOnCancel(t *testing.T) {
+	s := server.NewChiServer(nil, &server.ChiServerOptions{
+		HTTPPort:              8080,
+		DisableOIDCMiddleware: true,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.RunWithContext(ctx)
+	for !s.IsStarted() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	stopped := func() bool {
+		_, err := net.Dial("tcp", "localhost:8080")
+		return !s.IsStarted() && err != nil
+	}
+	for deadline := time.Now().Add(5 * time.Second); !stopped() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, stopped(), "server must stop listening when the context is cancelled")
+}
+
+func TestExpiredTokenRejectedOnKeepAliveConnection(t *testing.T) {
+	provider := newOIDCTestProvider(t)
+	defer provider.close()
+	oidcOptions := provider.options()
+	oidcOptions.TokenCacheSize = 10
+	s := newTestServer(func(r *chi.Mux) {
+		r.Get("/user", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Context().Value("user").(string)))
+		})
+	}, &server.ChiServerOptions{
+		OIDCOptions: oidcOptions,
+		ContextSetterOptions: server.ChiContextSetterOptions{
+			ClaimToContextKeyMapping: map[string]interface{}{"sub": "user"},
+		},
+	})
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	expiresAt := time.Now().Add(time.Second).Unix()
+	token := provider.token(t, jwt.MapClaims{"exp": expiresAt})
+	reused := make([]bool, 0, 2)
+	get := func() int {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/user", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { reused = append(reused, info.Reused) },
+		}))
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Server did not respond: %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, get())
+	// the token is expired once the second it expires in is over
+	time.Sleep(time.Until(time.Unix(expiresAt+1, 0)))
+	assert.Equal(t, http.StatusUnauthorized, get())
+	assert.Equal(t, []bool{false, true}, reused, "both requests must use the same connection")
+}
+
+func TestStopTwice(t *testing.T) {
+	h := getTestHelper(nil, &server.ChiServerOptions{
+		HTTPPort:              8080,
+		DisableOIDCMiddleware: true,
+	})
+
+	stopped := make(chan struct{})
+	go func() {
+		h.server.Stop()
+		h.server.Stop()
+		<-h.done
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop() called twice deadlocked")
+	}
+	assert.False(t, h.server.IsStarted())
+	// cleanup calls Stop() for the third time
+	h.cleanup()
+}
+
+func TestGetRoutesDocs(t *testing.T) {
+	s := server.NewChiServer(func(r *chi.Mux) {
+		r.Get("/hello", func(w http.ResponseWriter, r *http.Request) {})
+		r.Route("/items", func(r chi.Router) {
+			r.Get("/{id}", func(w http.ResponseWriter, r *http.Request) {})
+			r.Delete("/{id}", func(w http.ResponseWriter, r *http.Request) {})
+		})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+	})
+
+	var doc docgen.Doc
+	if err := json.Unmarshal([]byte(s.GetRoutesDocs()), &doc); err != nil {
+		t.Fatalf("Routes docs are not valid JSON: %v", err)
+	}
+	routes := doc.Router.Routes
+	assert.Contains(t, routes, "/hello")
+	assert.Contains(t, routes["/hello"].Handlers, "GET")
+	if assert.Contains(t, routes, "/items/*") && assert.NotNil(t, routes["/items/*"].Router) {
+		items := routes["/items/*"].Router.Routes
+		if assert.Contains(t, items, "/{id}") {
+			assert.Contains(t, items["/{id}"].Handlers, "GET")
+			assert.Contains(t, items["/{id}"].Handlers, "DELETE")
+		}
+	}
+}
+
+func TestStopConcurrently(t *testing.T) {
+	h := getTestHelper(nil, &server.ChiServerOptions{
+		HTTPPort:              8080,
+		DisableOIDCMiddleware: true,
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.server.Stop()
+		}()
+	}
+	wg.Wait()
+	h.cleanup()
+	assert.False(t, h.server.IsStarted())
+}
+
+func TestLogRequestHeaders(t *testing.T) {
+	s := newTestServer(nil, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		LogRequestHeaders:     []string{"X-Tenant", "x-client-version", "Authorization", "X-Missing"},
+	})
+	hook := &test.Hook{}
+	s.GetLogger().AddHook(hook)
+
+	req := httptest.NewRequest(http.MethodGet, "/hello", nil)
+	req.Header.Set("X-Tenant", "acme")
+	req.Header.Set("X-Client-Version", "1.2.3")
+	req.Header.Set("Authorization", "Bearer secret-token")
+	serveRequest(s, req)
+
+	entry := hook.LastEntry()
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, "acme", entry.Data["header_x_tenant"])
+		assert.Equal(t, "1.2.3", entry.Data["header_x_client_version"])
+		assert.Equal(t, middleware.RedactedHeaderValue, entry.Data["header_authorization"])
+		assert.NotContains(t, entry.Data, "header_x_missing")
+	}
+}
+
+func TestResetAndRunAgain(t *testing.T) {
+	h := getTestHelper(nil, &server.ChiServerOptions{
+		HTTPPort:              8080,
+		DisableOIDCMiddleware: true,
+	})
+	assert.NotNil(t, h.server.Reset(), "running server can't be reset")
+	h.cleanup()
+
+	assert.Nil(t, h.server.Reset())
+	done := make(chan struct{})
+	go func() {
+		h.server.Run()
+		close(done)
+	}()
+	for !h.server.IsStarted() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	status, body := h.getWithToken(t, "http://localhost:8080/hello", "")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "Hello root", body)
+
+	h.server.Stop()
+	<-done
+}
+
+func TestMetrics(t *testing.T) {
+	provider := newOIDCTestProvider(t)
+	defer provider.close()
+	s := newTestServer(func(r *chi.Mux) {
+		r.Get("/items/{id}", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("item"))
+		})
+	}, &server.ChiServerOptions{
+		OIDCOptions:   provider.options(),
+		EnableMetrics: true,
+	})
+
+	token := provider.token(t, nil)
+	for _, id := range []string{"1", "2"} {
+		status, _ := serveWithToken(s, "/items/"+id, token)
+		assert.Equal(t, 200, status)
+	}
+	status, _ := serveWithToken(s, "/items/3", "")
+	assert.Equal(t, 401, status)
+
+	// metrics endpoint doesn't require authentication
+	status, body := serveWithToken(s, "/metrics", "")
+	assert.Equal(t, 200, status)
+	assert.Contains(t, body, `http_requests_total{method="GET",path="/items/{id}",status="200"} 2`)
+	assert.Contains(t, body, `http_request_duration_seconds_count{method="GET",path="/items/{id}"} 2`)
+	assert.Contains(t, body, `http_requests_total{method="GET",path="unknown",status="401"} 1`)
+	assert.Contains(t, body, "http_requests_in_flight")
+	assert.NotNil(t, s.GetMetricsRegistry())
+}
+
+func TestGRPCWebPassthrough(t *testing.T) {
+	s := newTestServer(func(r *chi.Mux) {
+		r.Post("/pkg.Service/Method", func(w http.ResponseWriter, r *http.Request) {
+			assert.Nil(t, r.Context().Value(render.ContentTypeCtxKey), "gRPC-Web requests must not be forced to JSON")
+			w.Header().Set("Content-Type", "application/grpc-web+proto")
+			w.Header().Set("Grpc-Status", "5")
+			w.WriteHeader(http.StatusOK)
+		})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+	})
+	hook := &test.Hook{}
+	s.GetLogger().AddHook(hook)
+
+	req := httptest.NewRequest(http.MethodPost, "/pkg.Service/Method", strings.NewReader(""))
+	req.Header.Set("Content-Type", "application/grpc-web+proto")
+	rec := serveRequest(s, req)
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "application/grpc-web+proto", rec.Header().Get("Content-Type"))
+
+	entry := hook.LastEntry()
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, "grpc-web", entry.Data["rpc_protocol"])
+		assert.Equal(t, "5", entry.Data["grpc_status"])
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	s := newTestServer(func(r *chi.Mux) {
+		r.Get("/items/{id}", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		TracerProvider:        tracerProvider,
+	})
+	hook := &test.Hook{}
+	s.GetLogger().AddHook(hook)
+
+	req := httptest.NewRequest(http.MethodGet, "/items/1", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.Equal(t, http.StatusTeapot, serveRequest(s, req).Code)
+
+	spans := recorder.Ended()
+	if assert.Len(t, spans, 1) {
+		span := spans[0]
+		assert.Equal(t, "/items/{id}", span.Name())
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String())
+		assert.Equal(t, "00f067aa0ba902b7", span.Parent().SpanID().String())
+		assert.Contains(t, span.Attributes(), semconv.HTTPStatusCodeKey.Int(http.StatusTeapot))
+
+		entry := hook.LastEntry()
+		if assert.NotNil(t, entry) {
+			assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", entry.Data["trace_id"])
+			assert.Equal(t, span.SpanContext().SpanID().String(), entry.Data["span_id"])
+		}
+	}
+}
+
+func TestIssuerOnlyValidation(t *testing.T) {
+	provider := newOIDCTestProvider(t)
+	defer provider.close()
+
+	// audience is required by default
+	oidcOptions := provider.options()
+	oidcOptions.Audience = ""
+	assert.Panics(t, func() {
+		server.NewChiServer(nil, &server.ChiServerOptions{OIDCOptions: oidcOptions})
+	})
+
+	oidcOptions.SkipAudienceCheck = true
+	s := newTestServer(nil, &server.ChiServerOptions{
+		OIDCOptions: oidcOptions,
+	})
+
+	status, body := serveWithToken(s, "/hello", provider.token(t, jwt.MapClaims{"aud": nil}))
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "Hello root", body)
+	status, _ = serveWithToken(s, "/hello", provider.token(t, jwt.MapClaims{"aud": "other-service"}))
+	assert.Equal(t, 200, status)
+	status, _ = serveWithToken(s, "/hello", provider.token(t, jwt.MapClaims{"iss": "https://other-provider.com/"}))
+	assert.Equal(t, 401, status)
+}
+
+func TestContextHeaders(t *testing.T) {
+	s := newTestServer(func(r *chi.Mux) {
+		r.Get("/tenant", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(middleware.GetHeaderValue(r.Context(), "X-Ctx-Tenant")))
+			assert.Equal(t, map[string]string{"X-Ctx-Tenant": "acme", "X-Ctx-Locale": "pl-PL", "X-Api-Key": "secret"},
+				middleware.GetHeaderValues(r.Context()))
+		})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		ContextHeaders:        []string{"x-ctx-tenant", "X-Ctx-Locale", "X-Ctx-Flags", "x-api-key"},
+	})
+	hook := &test.Hook{}
+	s.GetLogger().AddHook(hook)
+
+	req := httptest.NewRequest(http.MethodGet, "/tenant", nil)
+	req.Header.Set("X-Ctx-Tenant", "acme")
+	req.Header.Set("X-Ctx-Locale", "pl-PL")
+	req.Header.Set("X-Api-Key", "secret")
+	assert.Equal(t, "acme", serveRequest(s, req).Body.String())
+
+	entry := hook.LastEntry()
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, "acme", entry.Data["header_x_ctx_tenant"])
+		assert.Equal(t, "pl-PL", entry.Data["header_x_ctx_locale"])
+		assert.NotContains(t, entry.Data, "header_x_ctx_flags")
+		assert.Equal(t, middleware.RedactedHeaderValue, entry.Data["header_x_api_key"])
+	}
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	s := newTestServer(nil, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+	})
+	hook := &test.Hook{}
+	s.GetLogger().AddHook(hook)
+
+	rec := serveRequest(s, httptest.NewRequest(http.MethodGet, "/hello", nil))
+	reqID := rec.Header().Get("X-Request-Id")
+	assert.NotEmpty(t, reqID)
+	if entry := hook.LastEntry(); assert.NotNil(t, entry) {
+		assert.Equal(t, reqID, entry.Data["req_id"])
+	}
+
+	s = newTestServer(nil, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		RequestIDHeader:       "X-Correlation-Id",
+	})
+	rec = serveRequest(s, httptest.NewRequest(http.MethodGet, "/hello", nil))
+	assert.NotEmpty(t, rec.Header().Get("X-Correlation-Id"))
+	assert.Empty(t, rec.Header().Get("X-Request-Id"))
+}
+
+func TestShutdownDrainLogging(t *testing.T) {
+	started := make(chan struct{})
+	h := getTestHelper(func(r *chi.Mux) {
+		r.Get("/slow", func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			time.Sleep(300 * time.Millisecond)
+			w.Write([]byte("done"))
+		})
+	}, &server.ChiServerOptions{
+		HTTPPort:              8080,
+		DisableOIDCMiddleware: true,
+	})
+	defer h.cleanup()
+	hook := &test.Hook{}
+	h.server.GetLogger().AddHook(hook)
+
+	go http.Get("http://localhost:8080/slow")
+	<-started
+	assert.Equal(t, int64(1), h.server.ActiveRequests())
+	h.server.Stop()
+
+	entry := hook.LastEntry()
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, "Shutdown done", entry.Message)
+		assert.Equal(t, int64(1), entry.Data["in_flight_requests"])
+		assert.Equal(t, int64(0), entry.Data["force_closed_requests"])
+		drain, ok := entry.Data["drain_duration_ms"].(float64)
+		assert.True(t, ok)
+		assert.True(t, drain >= 100 && drain < 5000, "unexpected drain duration %v", drain)
+	}
+}
+
+func TestMissingJwksSource(t *testing.T) {
+	provider := newOIDCTestProvider(t)
+	defer provider.close()
+
+	oidcOptions := provider.options()
+	jwksURL := oidcOptions.JwksURL
+	oidcOptions.JwksURL = ""
+	assert.Panics(t, func() {
+		server.NewChiServer(nil, &server.ChiServerOptions{OIDCOptions: oidcOptions})
+	})
+
+	// an offline key source is enough
+	resp, err := http.Get(jwksURL)
+	if err != nil {
+		t.Fatalf("Can't get JWKS: %v", err)
+	}
+	jwks, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err)
+	oidcOptions.JwksInline = string(jwks)
+	var s *server.ChiServer
+	assert.NotPanics(t, func() {
+		s = server.NewChiServer(func(r *chi.Mux) {
+			r.Get("/hello", func(w http.ResponseWriter, r *http.Request) {})
+		}, &server.ChiServerOptions{OIDCOptions: oidcOptions})
+	})
+	req := httptest.NewRequest("GET", "/hello", nil)
+	req.Header.Set("Authorization", "Bearer "+provider.token(t, nil))
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+}
+
+func TestNewChiServerE(t *testing.T) {
+	provider := newOIDCTestProvider(t)
+	defer provider.close()
+
+	// incomplete OIDC configuration
+	s, err := server.NewChiServerE(nil, &server.ChiServerOptions{
+		OIDCOptions: server.ChiOIDCMiddlewareOptions{Audience: "http://localhost"},
+	})
+	assert.Nil(t, s)
+	assert.EqualError(t, err,
+		"OIDC middleware is enabled in server configuration, but no valid configuration was provided")
+
+	oidcOptions := provider.options()
+	oidcOptions.PublicURLsPatterns = []string{"^/pub(lic"}
+	s, err = server.NewChiServerE(nil, &server.ChiServerOptions{OIDCOptions: oidcOptions})
+	assert.Nil(t, s)
+	assert.Contains(t, err.Error(), `invalid regular expression "^/pub(lic"`)
+
+	s, err = server.NewChiServerE(nil, &server.ChiServerOptions{OIDCOptions: provider.options()})
+	assert.Nil(t, err)
+	assert.NotNil(t, s)
+
+	// an unset password variable doesn't let anyone in with empty credentials
+	s, err = server.NewChiServerE(nil, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		BasicAuthOptions:      &server.ChiBasicAuthOptions{Users: map[string]string{"billing-job": ""}},
+	})
+	assert.Nil(t, s)
+	assert.EqualError(t, err, "invalid BasicAuthOptions: basic auth user billing-job has an empty password")
+
+	// rate limits, which would reject every request or let all of them through
+	for _, rateLimit := range []server.ChiRateLimitOptions{
+		{Requests: 0, Interval: time.Minute},
+		{Requests: 10, Interval: 0},
+		{Requests: 10, Interval: time.Minute, Burst: -1},
+	} {
+		rateLimit := rateLimit
+		s, err = server.NewChiServerE(nil, &server.ChiServerOptions{
+			DisableOIDCMiddleware: true,
+			RateLimitOptions:      &rateLimit,
+		})
+		assert.Nil(t, s)
+		assert.Contains(t, err.Error(), "invalid RateLimitOptions")
+	}
+
+	// NewChiServer keeps panicking
+	assert.Panics(t, func() {
+		server.NewChiServer(nil, &server.ChiServerOptions{})
+	})
+}
+
+func TestContextSetterRejectsReservedKeys(t *testing.T) {
+	provider := newOIDCTestProvider(t)
+	defer provider.close()
+
+	for _, key := range []interface{}{middleware.CtxJWTKey, render.ContentTypeCtxKey} {
+		assert.Panics(t, func() {
+			server.NewChiServer(nil, &server.ChiServerOptions{
+				OIDCOptions: provider.options(),
+				ContextSetterOptions: server.ChiContextSetterOptions{
+					ClaimToContextKeyMapping: map[string]interface{}{"sub": key},
+				},
+			})
+		}, "mapping to %v must be rejected", key)
+	}
+	assert.NotNil(t, middleware.CheckContextKeys(map[string]interface{}{"sub": "jwt_token"}))
+	assert.Nil(t, middleware.CheckContextKeys(map[string]interface{}{"sub": "user"}))
+	// keys of the UserInfoSetter, which RequireAdmin and RequireRoles trust
+	for _, key := range []interface{}{middleware.CtxUserKey, middleware.CtxRolesKey, middleware.CtxIsAdminKey} {
+		assert.NotNil(t, middleware.CheckContextKeys(map[string]interface{}{"groups": key}), "mapping to %v must be rejected", key)
+	}
+}
+
+func TestLogFormatterAndOutput(t *testing.T) {
+	var out bytes.Buffer
+	s := server.NewChiServer(nil, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		LogFormatter:          &logrus.TextFormatter{DisableTimestamp: true},
+		LogOutput:             &out,
+	})
+	s.GetLogger().Info("text log")
+	assert.Equal(t, "level=info msg=\"text log\"\n", out.String())
+
+	// JSON without timestamps is the default
+	out.Reset()
+	s = server.NewChiServer(nil, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		LogOutput:             &out,
+	})
+	s.GetLogger().Info("json log")
+	assert.Equal(t, "{\"level\":\"info\",\"msg\":\"json log\"}\n", out.String())
+}
+
+func TestExternalLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.Formatter = &logrus.TextFormatter{DisableTimestamp: true}
+	logger.Out = &out
+	logger.Level = logrus.WarnLevel
+	hook := &test.Hook{}
+	logger.AddHook(hook)
+
+	s := server.NewChiServer(nil, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		Logger:                logger,
+		LoggerFields:          logrus.Fields{"app": "test"},
+	})
+	assert.Same(t, logger, s.GetLogger())
+	// the logger's own configuration is kept
+	s.GetLogger().Warn("warning")
+	s.GetLogger().Info("filtered out")
+	assert.Equal(t, "level=warning msg=warning\n", out.String())
+	assert.Len(t, hook.AllEntries(), 1)
+}
+
+func TestLogSkipPaths(t *testing.T) {
+	s := newTestServer(func(r *chi.Mux) {
+		r.Get("/hello", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Hello root"))
+		})
+		r.Get("/debug/vars", func(w http.ResponseWriter, r *http.Request) {})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		LogSkipPaths:          []string{"/ping", "/debug/*"},
+	})
+	hook := &test.Hook{}
+	s.GetLogger().AddHook(hook)
+
+	for _, path := range []string{"/ping", "/debug/vars", "/hello"} {
+		status, _ := serveWithToken(s, path, "")
+		assert.Equal(t, 200, status)
+	}
+
+	entries := hook.AllEntries()
+	if assert.Len(t, entries, 2) {
+		for _, entry := range entries {
+			assert.Equal(t, "http://example.com/hello", entry.Data["uri"])
+		}
+	}
+
+	hook.Reset()
+	s.GetLogger().SetLevel(logrus.DebugLevel)
+	serveWithToken(s, "/ping", "")
+	if entry := hook.LastEntry(); assert.NotNil(t, entry) {
+		assert.Equal(t, logrus.DebugLevel, entry.Level)
+		assert.Equal(t, "request complete", entry.Message)
+	}
+}
+
+func TestLogRoutePattern(t *testing.T) {
+	s := newTestServer(func(r *chi.Mux) {
+		r.Route("/users", func(r chi.Router) {
+			r.Get("/{id}", func(w http.ResponseWriter, r *http.Request) {})
+		})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+	})
+	hook := &test.Hook{}
+	s.GetLogger().AddHook(hook)
+
+	status, _ := serveWithToken(s, "/users/42", "")
+	assert.Equal(t, 200, status)
+
+	if entry := hook.LastEntry(); assert.NotNil(t, entry) {
+		assert.Equal(t, "request complete", entry.Message)
+		assert.Equal(t, "/users/{id}", entry.Data["route"])
+		assert.Equal(t, "http://example.com/users/42", entry.Data["uri"])
+	}
+}
+
+func TestLogLevelsByStatus(t *testing.T) {
+	s := newTestServer(func(r *chi.Mux) {
+		r.Get("/ok", func(w http.ResponseWriter, r *http.Request) {})
+		r.Get("/missing", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		})
+		r.Get("/failing", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		})
+		r.Get("/panic", func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+	})
+	hook := &test.Hook{}
+	s.GetLogger().AddHook(hook)
+
+	cases := []struct {
+		path        string
+		status      int
+		statusText  string
+		statusClass string
+		level       logrus.Level
+	}{
+		{"/ok", 200, "OK", "2xx", logrus.InfoLevel},
+		{"/missing", 404, "Not Found", "4xx", logrus.InfoLevel},
+		{"/failing", 502, "Bad Gateway", "5xx", logrus.WarnLevel},
+		{"/panic", 500, "Internal Server Error", "5xx", logrus.ErrorLevel},
+	}
+	for _, c := range cases {
+		status, _ := serveWithToken(s, c.path, "")
+		assert.Equal(t, c.status, status)
+		if entry := hook.LastEntry(); assert.NotNil(t, entry) {
+			assert.Equal(t, "request complete", entry.Message, c.path)
+			assert.Equal(t, c.level, entry.Level, c.path)
+			assert.Equal(t, c.statusText, entry.Data["resp_status_text"], c.path)
+			assert.Equal(t, c.statusClass, entry.Data["status_class"], c.path)
+		}
+	}
+}
+
+func TestLogOmitPanicStack(t *testing.T) {
+	for _, omit := range []bool{false, true} {
+		s := newTestServer(func(r *chi.Mux) {
+			r.Get("/panic", func(w http.ResponseWriter, r *http.Request) {
+				panic("boom")
+			})
+		}, &server.ChiServerOptions{
+			DisableOIDCMiddleware: true,
+			LogOmitPanicStack:     omit,
+		})
+		hook := &test.Hook{}
+		s.GetLogger().AddHook(hook)
+
+		status, _ := serveWithToken(s, "/panic", "")
+		assert.Equal(t, 500, status)
+		if entry := hook.LastEntry(); assert.NotNil(t, entry) {
+			assert.Equal(t, "boom", entry.Data["panic"])
+			_, hasStack := entry.Data["stack"]
+			assert.Equal(t, !omit, hasStack)
+		}
+	}
+}
+
+func TestLogBodies(t *testing.T) {
+	s := newTestServer(func(r *chi.Mux) {
+		r.Post("/echo", func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			assert.Nil(t, err)
+			w.Write(body)
+		})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		LogBodies:             true,
+		LogBodyMaxBytes:       10,
+	})
+	hook := &test.Hook{}
+	s.GetLogger().AddHook(hook)
+
+	post := func(payload string) string {
+		req := httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "text/plain")
+		return serveRequest(s, req).Body.String()
+	}
+
+	assert.Equal(t, "short", post("short"))
+	if entry := hook.LastEntry(); assert.NotNil(t, entry) {
+		assert.Equal(t, "short", entry.Data["req_body"])
+		assert.Equal(t, "short", entry.Data["resp_body"])
+		assert.Equal(t, int64(5), entry.Data["req_bytes_length"])
+		assert.NotContains(t, entry.Data, "req_body_truncated")
+	}
+
+	// handler still gets the whole body, while logs get only the capped part
+	long := strings.Repeat("x", 100)
+	assert.Equal(t, long, post(long))
+	if entry := hook.LastEntry(); assert.NotNil(t, entry) {
+		assert.Equal(t, strings.Repeat("x", 10), entry.Data["req_body"])
+		assert.Equal(t, strings.Repeat("x", 10), entry.Data["resp_body"])
+		assert.Equal(t, int64(100), entry.Data["req_bytes_length"])
+		assert.Equal(t, true, entry.Data["req_body_truncated"])
+		assert.Equal(t, true, entry.Data["resp_body_truncated"])
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s := newTestServer(nil, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		RateLimitOptions: &server.ChiRateLimitOptions{
+			Requests: 1,
+			Interval: time.Minute,
+			Burst:    2,
+		},
+	})
+	get := func(realIP string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/hello", nil)
+		req.Header.Set("X-Real-IP", realIP)
+		return serveRequest(s, req)
+	}
+
+	assert.Equal(t, 200, get("10.0.0.1").Code)
+	assert.Equal(t, 200, get("10.0.0.1").Code)
+	rec := get("10.0.0.1")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	assert.Nil(t, err)
+	assert.True(t, retryAfter > 0 && retryAfter <= 60, "unexpected Retry-After %d", retryAfter)
+	// other clients have their own limits
+	assert.Equal(t, 200, get("10.0.0.2").Code)
+}
+
+func TestRateLimitBySubject(t *testing.T) {
+	provider := newOIDCTestProvider(t)
+	defer provider.close()
+	s := newTestServer(nil, &server.ChiServerOptions{
+		OIDCOptions: provider.options(),
+		ContextSetterOptions: server.ChiContextSetterOptions{
+			ClaimToContextKeyMapping: map[string]interface{}{"sub": "user"},
+		},
+		RateLimitOptions: &server.ChiRateLimitOptions{
+			Requests: 1,
+			Interval: time.Minute,
+			KeyFunc: func(r *http.Request) string {
+				return r.Context().Value("user").(string)
+			},
+		},
+	})
+
+	alice := provider.token(t, jwt.MapClaims{"sub": "alice"})
+	bob := provider.token(t, jwt.MapClaims{"sub": "bob"})
+	status, _ := serveWithToken(s, "/hello", alice)
+	assert.Equal(t, 200, status)
+	status, _ = serveWithToken(s, "/hello", alice)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	status, _ = serveWithToken(s, "/hello", bob)
+	assert.Equal(t, 200, status)
+}
+
+func TestMaxRequestBodyBytes(t *testing.T) {
+	s := newTestServer(func(r *chi.Mux) {
+		r.Post("/upload", func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				render.Render(w, r, middleware.ErrRequestTooLarge(err))
+				return
+			}
+			w.Write([]byte(strconv.Itoa(len(body))))
+		})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		MaxRequestBodyBytes:   10,
+	})
+	post := func(body io.Reader) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, "/upload", body)
+		req.Header.Set("Content-Type", "text/plain")
+		rec := serveRequest(s, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	status, body := post(strings.NewReader("small"))
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "5", body)
+	// rejected based on Content-Length
+	status, _ = post(strings.NewReader(strings.Repeat("x", 11)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	// chunked body without Content-Length fails when read by the handler
+	status, body = post(ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 100))))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Contains(t, body, "request body too large")
+}
+
+func TestErrorRenderers(t *testing.T) {
+	s := newTestServer(func(r *chi.Mux) {
+		r.Get("/missing", func(w http.ResponseWriter, r *http.Request) {
+			render.Render(w, r, middleware.ErrResourceNotFound(errors.New("no such item")))
+		})
+		r.Get("/legacy", func(w http.ResponseWriter, r *http.Request) {
+			render.Render(w, r, middleware.ErrNotFound)
+		})
+		r.Get("/bad", func(w http.ResponseWriter, r *http.Request) {
+			render.Render(w, r, middleware.ErrBadRequest(errors.New("missing parameter")))
+		})
+		r.Get("/broken", func(w http.ResponseWriter, r *http.Request) {
+			render.Render(w, r, middleware.ErrInternal(errors.New("database password expired")))
+		})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+	})
+
+	cases := map[string]struct {
+		status int
+		body   map[string]interface{}
+	}{
+		"/missing": {404, map[string]interface{}{"status": "Resource not found.", "error": "no such item"}},
+		"/bad":     {400, map[string]interface{}{"status": "Invalid request.", "error": "missing parameter"}},
+		"/broken":  {500, map[string]interface{}{"status": "Internal server error.", "error": "internal server error"}},
+	}
+	for path, c := range cases {
+		rec := serveRequest(s, httptest.NewRequest(http.MethodGet, path, nil))
+		body := map[string]interface{}{}
+		assert.Nil(t, json.NewDecoder(rec.Body).Decode(&body))
+		assert.Equal(t, c.status, rec.Code, path)
+		c.body["request_id"] = rec.Header().Get("X-Request-Id")
+		assert.Equal(t, c.body, body, path)
+	}
+
+	// the shared ErrNotFound value must not keep the ID of the first request
+	for i := 0; i < 2; i++ {
+		rec := serveRequest(s, httptest.NewRequest(http.MethodGet, "/legacy", nil))
+		body := map[string]interface{}{}
+		assert.Nil(t, json.NewDecoder(rec.Body).Decode(&body))
+		assert.Equal(t, 404, rec.Code)
+		assert.Equal(t, map[string]interface{}{"status": "Resource not found."}, body)
+	}
+}
+
+func TestRecovererOptions(t *testing.T) {
+	panicking := func(r *chi.Mux) {
+		r.Get("/panic", func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		})
+	}
+
+	s := newTestServer(panicking, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+	})
+	hook := &test.Hook{}
+	s.GetLogger().AddHook(hook)
+	rec := serveRequest(s, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	body := map[string]interface{}{}
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&body))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, "application/json; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Equal(t, map[string]interface{}{
+		"status":     "Internal server error.",
+		"error":      "internal server error",
+		"request_id": rec.Header().Get("X-Request-Id"),
+	}, body)
+	assert.NotEmpty(t, body["request_id"])
+	if entry := hook.LastEntry(); assert.NotNil(t, entry) {
+		assert.Equal(t, logrus.ErrorLevel, entry.Level)
+		assert.Equal(t, "boom", entry.Data["panic"])
+	}
+
+	s = newTestServer(panicking, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+		DisableRecoverer:      true,
+	})
+	s.GetLogger().SetOutput(ioutil.Discard)
+	assert.Panics(t, func() {
+		serveRequest(s, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	}, "without the recoverer the panic is left to net/http")
+}
+
+func TestLogTimestamp(t *testing.T) {
+	cases := []struct {
+		field, format    string
+		logField, layout string
+	}{
+		{"", "", "ts", time.RFC3339Nano},
+		{"@timestamp", time.RFC1123, "@timestamp", time.RFC1123},
+	}
+	for _, c := range cases {
+		s := newTestServer(nil, &server.ChiServerOptions{
+			DisableOIDCMiddleware: true,
+			LogTimestampField:     c.field,
+			LogTimestampFormat:    c.format,
+		})
+		hook := &test.Hook{}
+		s.GetLogger().AddHook(hook)
+
+		status, _ := serveWithToken(s, "/hello", "")
+		assert.Equal(t, 200, status)
+		if entry := hook.LastEntry(); assert.NotNil(t, entry) {
+			value, ok := entry.Data[c.logField].(string)
+			assert.True(t, ok, "missing %s field", c.logField)
+			ts, err := time.Parse(c.layout, value)
+			assert.Nil(t, err)
+			assert.WithinDuration(t, time.Now(), ts, time.Minute)
+		}
+	}
+}
+
+func TestH2C(t *testing.T) {
+	started := make(chan struct{})
+	h := getTestHelper(func(r *chi.Mux) {
+		r.Get("/proto", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		})
+		r.Get("/slow", func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			time.Sleep(500 * time.Millisecond)
+			w.Write([]byte("done"))
+		})
+	}, &server.ChiServerOptions{
+		HTTPPort:                8080,
+		DisableOIDCMiddleware:   true,
+		EnableH2C:               true,
+		GracefulShutdownTimeSec: 5,
+	})
+	defer h.cleanup()
+	h2cClient := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+
+	res, err := h2cClient.Get("http://localhost:8080/proto")
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, 2, res.ProtoMajor)
+	assert.Equal(t, "HTTP/2.0", string(body))
+
+	// HTTP/1.1 clients are still served
+	status, body1 := h.getWithToken(t, "http://localhost:8080/proto", "")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "HTTP/1.1", body1)
+
+	results := make(chan string, 1)
+	go func() {
+		res, err := h2cClient.Get("http://localhost:8080/slow")
+		if err != nil {
+			results <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		results <- string(body)
+	}()
+	<-started
+	h.server.Stop()
+
+	select {
+	case res := <-results:
+		assert.Equal(t, "done", res)
+	case <-time.After(time.Second):
+		t.Fatalf("Slow HTTP/2 request was not completed during graceful shutdown")
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	// slowClient sends an incomplete request and reports if the server closed the connection
+	slowClient := func() bool {
+		conn, err := net.Dial("tcp", "localhost:8080")
+		if !assert.Nil(t, err) {
+			return false
+		}
+		defer conn.Close()
+		conn.Write([]byte("GET /hello HTTP/1.1\r\nHost: localhost\r\n"))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		netErr, ok := err.(net.Error)
+		return err != nil && !(ok && netErr.Timeout())
+	}
+
+	h := getTestHelper(nil, &server.ChiServerOptions{
+		HTTPPort:              8080,
+		DisableOIDCMiddleware: true,
+		ReadHeaderTimeout:     200 * time.Millisecond,
+	})
+	assert.True(t, slowClient(), "connection with slow headers must be closed")
+	h.cleanup()
+
+	// the timeouts are kept after Reset()
+	assert.Nil(t, h.server.Reset())
+	done := make(chan struct{})
+	go func() {
+		h.server.Run()
+		close(done)
+	}()
+	for !h.server.IsStarted() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, slowClient(), "connection with slow headers must be closed after Reset()")
+	h.server.Stop()
+	<-done
+
+	h = getTestHelper(nil, &server.ChiServerOptions{
+		HTTPPort:               8080,
+		DisableOIDCMiddleware:  true,
+		DisableDefaultTimeouts: true,
+	})
+	defer h.cleanup()
+	assert.False(t, slowClient(), "without timeouts the connection must be kept open")
+}
+
+func TestRouterMount(t *testing.T) {
+	s := newTestServer(nil, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+	})
+	sub := chi.NewRouter()
+	sub.Get("/users", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("users"))
+	})
+	s.Router().Mount("/admin", sub)
+
+	rec := serveRequest(s, httptest.NewRequest(http.MethodGet, "/admin/users", nil))
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "users", rec.Body.String())
+	// the server middleware applies to the mounted routes
+	assert.NotEmpty(t, rec.Header().Get("X-Request-Id"))
+}
+
+// the registration callback and the router use chi v5 types
+var (
+	_ func(r *chi.Mux) = func(r *chi.Mux) {}
+	_ chi.Router       = (&server.ChiServer{}).Router()
+)
+
+func TestChiV5Routes(t *testing.T) {
+	s := newTestServer(func(r *chi.Mux) {
+		r.Route("/v5", func(r chi.Router) {
+			r.With(chimiddleware.NoCache).Get("/items/{id}", func(w http.ResponseWriter, r *http.Request) {
+				// the request ID set by the server is visible with chi v5 middleware helpers
+				w.Write([]byte(chi.URLParam(r, "id") + " " + chimiddleware.GetReqID(r.Context())))
+			})
+		})
+	}, &server.ChiServerOptions{
+		DisableOIDCMiddleware: true,
+	})
+
+	rec := serveRequest(s, httptest.NewRequest(http.MethodGet, "/v5/items/42", nil))
+	assert.Equal(t, 200, rec.Code)
+	reqID := rec.Header().Get("X-Request-Id")
+	assert.NotEmpty(t, reqID)
+	assert.Equal(t, "42 "+reqID, rec.Body.String())
+	assert.NotEmpty(t, rec.Header().Get("Cache-Control"))
 }